@@ -0,0 +1,288 @@
+package env
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/flarco/g"
+	"gopkg.in/yaml.v3"
+)
+
+// envFileMux serializes the changes of the dbNet env file
+var envFileMux sync.Mutex
+
+// SetConnection adds or replaces the connection in the dbNet env file.
+// The file is edited in place: the comments, the other entries and the
+// `${VAR}` references are kept. The name is matched case-insensitively.
+func SetConnection(name string, props map[string]any) (err error) {
+	envFileMux.Lock()
+	defer envFileMux.Unlock()
+
+	doc, err := readEnvFileNode()
+	if err != nil {
+		return err
+	}
+
+	conns, err := mappingValue(doc.Content[0], "connections")
+	if err != nil {
+		return err
+	}
+
+	i := mappingIndex(conns, name)
+	if i < 0 {
+		conns.Content = append(conns.Content, newScalarNode(name), &yaml.Node{})
+		i = len(conns.Content) - 2
+	}
+
+	if err = setConnectionNode(conns.Content[i+1], props); err != nil {
+		return g.Error(err, "could not set connection %s", name)
+	}
+	return writeEnvFileNode(doc)
+}
+
+// RemoveConnection removes the connection from the dbNet env file.
+// Returns false if it is not defined in the file.
+func RemoveConnection(name string) (found bool, err error) {
+	envFileMux.Lock()
+	defer envFileMux.Unlock()
+
+	doc, err := readEnvFileNode()
+	if err != nil {
+		return false, err
+	}
+
+	conns, err := mappingValue(doc.Content[0], "connections")
+	if err != nil {
+		return false, err
+	}
+
+	i := mappingIndex(conns, name)
+	if i < 0 {
+		return false, nil
+	}
+
+	conns.Content = append(conns.Content[:i], conns.Content[i+2:]...)
+	return true, writeEnvFileNode(doc)
+}
+
+// GetConnection returns the properties of the connection in the dbNet
+// env file, as written (the `${VAR}` references are not expanded).
+// Returns nil if it is not defined in the file.
+func GetConnection(name string) (props map[string]any, err error) {
+	envFileMux.Lock()
+	defer envFileMux.Unlock()
+
+	doc, err := readEnvFileNode()
+	if err != nil {
+		return nil, err
+	}
+
+	conns, err := mappingValue(doc.Content[0], "connections")
+	if err != nil {
+		return nil, err
+	}
+
+	i := mappingIndex(conns, name)
+	if i < 0 {
+		return nil, nil
+	}
+
+	props = map[string]any{}
+	if err = conns.Content[i+1].Decode(&props); err != nil {
+		return nil, g.Error(err, "could not decode connection %s", name)
+	}
+	return props, nil
+}
+
+// ListConnections returns the names of the connections of the dbNet env file
+func ListConnections() (names []string, err error) {
+	envFileMux.Lock()
+	defer envFileMux.Unlock()
+
+	doc, err := readEnvFileNode()
+	if err != nil {
+		return nil, err
+	}
+
+	conns, err := mappingValue(doc.Content[0], "connections")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(conns.Content); i += 2 {
+		names = append(names, conns.Content[i].Value)
+	}
+	return names, nil
+}
+
+// readEnvFileNode parses the dbNet env file, without expanding the
+// variables. A missing or empty file is an empty document.
+func readEnvFileNode() (doc *yaml.Node, err error) {
+	doc = &yaml.Node{}
+	content, err := os.ReadFile(HomeDirEnvFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, g.Error(err, "could not read env file %s", HomeDirEnvFile)
+	} else if err = yaml.Unmarshal(content, doc); err != nil {
+		return nil, g.Error(err, "could not parse env file %s", HomeDirEnvFile)
+	}
+
+	if doc.Kind == 0 {
+		// empty, or only comments (which are not parsed)
+		doc.Kind = yaml.DocumentNode
+		doc.HeadComment = strings.TrimSpace(string(content))
+		if doc.HeadComment == "" {
+			doc.HeadComment = "# Environment Credentials for dbNet\n# See https://docs.dbnet.io/"
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	} else if root := doc.Content[0]; root.Kind != yaml.MappingNode {
+		if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+			toMapping(root)
+		} else {
+			return nil, g.Error("env file %s is not a YAML mapping", HomeDirEnvFile)
+		}
+	}
+	return doc, nil
+}
+
+// writeEnvFileNode writes the document to the dbNet env file. The file
+// is replaced atomically, and only readable by the user (credentials).
+func writeEnvFileNode(doc *yaml.Node) (err error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(doc); err != nil {
+		return g.Error(err, "could not encode env file")
+	} else if err = encoder.Close(); err != nil {
+		return g.Error(err, "could not encode env file")
+	}
+
+	mode := os.FileMode(0600)
+	if stat, err := os.Stat(HomeDirEnvFile); err == nil {
+		mode = stat.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(HomeDirEnvFile), ".env.yaml.*")
+	if err != nil {
+		return g.Error(err, "could not create temporary env file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return g.Error(err, "could not write temporary env file")
+	} else if err = tmp.Close(); err != nil {
+		return g.Error(err, "could not write temporary env file")
+	} else if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return g.Error(err, "could not set env file permissions")
+	} else if err = os.Rename(tmp.Name(), HomeDirEnvFile); err != nil {
+		return g.Error(err, "could not replace env file %s", HomeDirEnvFile)
+	}
+	return nil
+}
+
+// setConnectionNode sets the properties of the connection node. The
+// existing keys keep their position and comments (and their value if
+// unchanged), the removed keys are deleted, and the new ones are
+// appended (type first, then sorted).
+func setConnectionNode(node *yaml.Node, props map[string]any) (err error) {
+	if node.Kind != yaml.MappingNode {
+		comment := node.LineComment
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", LineComment: comment}
+	}
+
+	content := []*yaml.Node{}
+	done := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		val, ok := props[key.Value]
+		if !ok {
+			continue // removed
+		}
+
+		done[key.Value] = true
+		var current any
+		if value.Decode(&current) == nil && g.Marshal(current) == g.Marshal(val) {
+			content = append(content, key, value) // unchanged, keep the style
+			continue
+		}
+
+		newValue := &yaml.Node{}
+		if err = newValue.Encode(val); err != nil {
+			return g.Error(err, "could not encode %s", key.Value)
+		}
+		newValue.HeadComment, newValue.LineComment, newValue.FootComment = value.HeadComment, value.LineComment, value.FootComment
+		content = append(content, key, newValue)
+	}
+
+	keys := []string{}
+	for key := range props {
+		if !done[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == "type" || keys[j] == "type" {
+			return keys[i] == "type"
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		value := &yaml.Node{}
+		if err = value.Encode(props[key]); err != nil {
+			return g.Error(err, "could not encode %s", key)
+		}
+		content = append(content, newScalarNode(key), value)
+	}
+
+	node.Content = content
+	return nil
+}
+
+// mappingValue returns the mapping value of the key, which
+// is created (or converted from an empty value) if needed
+func mappingValue(mapping *yaml.Node, key string) (value *yaml.Node, err error) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+
+		value = mapping.Content[i+1]
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			toMapping(value)
+		} else if value.Kind != yaml.MappingNode {
+			return nil, g.Error("the %s entry of env file %s is not a YAML mapping", key, HomeDirEnvFile)
+		}
+		return value, nil
+	}
+
+	value = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mapping.Content = append(mapping.Content, newScalarNode(key), value)
+	return value, nil
+}
+
+// mappingIndex returns the index of the key node (case-insensitive), or -1
+func mappingIndex(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// toMapping converts an empty (null) node into a mapping, keeping the comments
+func toMapping(node *yaml.Node) {
+	node.Kind, node.Tag, node.Value, node.Style = yaml.MappingNode, "!!map", "", 0
+	node.Content = nil
+}
+
+func newScalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
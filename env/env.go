@@ -2,8 +2,11 @@ package env
 
 import (
 	"os"
+	"path"
+	"strings"
 
 	env "github.com/slingdata-io/sling-cli/core/env"
+	"github.com/spf13/cast"
 )
 
 var (
@@ -32,3 +35,22 @@ func LoadDbNetEnvFile() (ef env.EnvFile) {
 	Env.TopComment = "# Environment Credentials for dbNet\n# See https://docs.dbnet.io/\n"
 	return
 }
+
+// GetVar returns the value of the environment variable, or of
+// the `variables` section of the dbNet env file
+func GetVar(key string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	for k, v := range env.LoadEnvFile(HomeDirEnvFile).Variables {
+		if strings.EqualFold(k, key) {
+			return cast.ToString(v)
+		}
+	}
+	return ""
+}
+
+// SpillDir is the folder of the detached query results
+func SpillDir() string {
+	return path.Join(HomeDir, "spill")
+}
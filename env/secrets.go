@@ -0,0 +1,283 @@
+package env
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/flarco/g"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretPrefix is the prefix of the encrypted values of the env file
+const SecretPrefix = "enc:v1:"
+
+const (
+	secretSaltLen  = 16
+	secretNonceLen = 12
+)
+
+// SecretProps are the connection properties which are encrypted
+var SecretProps = []string{
+	"password", "passphrase", "private_key", "private_key_passphrase",
+	"ssh_password", "ssh_private_key", "ssh_passphrase", "tunnel_passphrase",
+	"secret_access_key", "aws_secret_access_key", "session_token", "aws_session_token",
+	"account_key", "sas_svc_url", "conn_str", "client_secret", "token", "api_key",
+	"keyfile_json", "credentials_json",
+}
+
+var (
+	secretMux  sync.Mutex
+	secretKeys = map[string][]byte{} // derived keys, by material + salt
+	secretSalt []byte                // salt of the values encrypted by this process
+)
+
+// secretMaterial returns the master passphrase (`DBNET_SECRET_PASSPHRASE`,
+// only from the environment so it is never stored next to the secrets)
+// or the content of the key file (`DBNET_SECRET_KEYFILE`).
+func secretMaterial() (material []byte, err error) {
+	if passphrase := os.Getenv("DBNET_SECRET_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	keyFile := GetVar("DBNET_SECRET_KEYFILE")
+	if keyFile == "" {
+		return nil, g.Error("no secret key defined. Please set DBNET_SECRET_PASSPHRASE or DBNET_SECRET_KEYFILE")
+	}
+
+	material, err = os.ReadFile(keyFile)
+	if err != nil {
+		return nil, g.Error(err, "could not read secret key file %s", keyFile)
+	} else if material = []byte(strings.TrimSpace(string(material))); len(material) < 16 {
+		return nil, g.Error("secret key file %s is too short (16 characters minimum)", keyFile)
+	}
+	return material, nil
+}
+
+// HasSecretKey returns true if a passphrase or a key file is defined
+func HasSecretKey() bool {
+	return os.Getenv("DBNET_SECRET_PASSPHRASE") != "" || GetVar("DBNET_SECRET_KEYFILE") != ""
+}
+
+// GenerateKeyFile writes a new random key file, only readable by the user
+func GenerateKeyFile(path string) (err error) {
+	if g.PathExists(path) {
+		return g.Error("key file %s already exists", path)
+	}
+
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return g.Error(err, "could not generate secret key")
+	}
+
+	content := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err = os.WriteFile(path, []byte(content), 0600); err != nil {
+		return g.Error(err, "could not write key file %s", path)
+	}
+	return nil
+}
+
+// secretKey derives the encryption key of the salt
+func secretKey(salt []byte) (key []byte, err error) {
+	material, err := secretMaterial()
+	if err != nil {
+		return nil, err
+	}
+
+	secretMux.Lock()
+	defer secretMux.Unlock()
+
+	id := string(material) + string(salt)
+	if key, ok := secretKeys[id]; ok {
+		return key, nil
+	}
+
+	key, err = scrypt.Key(material, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, g.Error(err, "could not derive secret key")
+	}
+	secretKeys[id] = key
+	return key, nil
+}
+
+// IsEncrypted returns true if the value is an encrypted secret,
+// or a URL with an encrypted password
+func IsEncrypted(value any) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	} else if strings.HasPrefix(s, SecretPrefix) {
+		return true
+	}
+	_, password := urlPassword(s)
+	return strings.HasPrefix(password, SecretPrefix)
+}
+
+// IsSecretProp returns true if the connection property should be
+// encrypted. For URLs, only the password is.
+func IsSecretProp(key string, value any) bool {
+	s, ok := value.(string)
+	if !ok || s == "" || IsEncrypted(s) || strings.HasPrefix(s, "${") {
+		return false // not a plain value (`${VAR}` references are kept)
+	}
+
+	key = strings.ToLower(key)
+	if key == "url" {
+		_, password := urlPassword(s)
+		return password != "" && !strings.HasPrefix(password, "${")
+	}
+	return g.In(key, SecretProps...)
+}
+
+// urlPassword returns the parsed URL and its password, if any
+func urlPassword(s string) (u *url.URL, password string) {
+	if !strings.Contains(s, "://") {
+		return nil, ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return nil, ""
+	}
+	password, _ = u.User.Password()
+	return u, password
+}
+
+// encryptURL returns the URL with its password encrypted, so that the
+// type and host of the connection can still be read from it
+func encryptURL(s string) (encrypted string, err error) {
+	u, password := urlPassword(s)
+	if password, err = EncryptSecret(password); err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// decryptURL returns the URL with its password decrypted
+func decryptURL(s string) (decrypted string, err error) {
+	u, password := urlPassword(s)
+	if password, err = DecryptSecret(password); err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// EncryptSecret encrypts the value with AES-256-GCM
+func EncryptSecret(value string) (encrypted string, err error) {
+	secretMux.Lock()
+	if secretSalt == nil {
+		secretSalt = make([]byte, secretSaltLen)
+		if _, err = rand.Read(secretSalt); err != nil {
+			secretSalt = nil
+		}
+	}
+	salt := secretSalt
+	secretMux.Unlock()
+	if err != nil {
+		return "", g.Error(err, "could not generate salt")
+	}
+
+	gcm, err := secretCipher(salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, secretNonceLen)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", g.Error(err, "could not generate nonce")
+	}
+
+	payload := append(append(append([]byte{}, salt...), nonce...), gcm.Seal(nil, nonce, []byte(value), nil)...)
+	return SecretPrefix + base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+// DecryptSecret decrypts the value. Plain values are returned as is.
+func DecryptSecret(value string) (decrypted string, err error) {
+	if !strings.HasPrefix(value, SecretPrefix) {
+		return value, nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, SecretPrefix))
+	if err != nil || len(payload) < secretSaltLen+secretNonceLen {
+		return "", g.Error("invalid encrypted value")
+	}
+
+	salt, nonce := payload[:secretSaltLen], payload[secretSaltLen:secretSaltLen+secretNonceLen]
+	gcm, err := secretCipher(salt)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := gcm.Open(nil, nonce, payload[secretSaltLen+secretNonceLen:], nil)
+	if err != nil {
+		return "", g.Error("could not decrypt value, is the secret key correct?")
+	}
+	return string(plain), nil
+}
+
+func secretCipher(salt []byte) (gcm cipher.AEAD, err error) {
+	key, err := secretKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, g.Error(err, "could not create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptProps returns the properties with the plain secrets encrypted
+func EncryptProps(props map[string]any) (encrypted map[string]any, err error) {
+	encrypted = make(map[string]any, len(props))
+	for k, v := range props {
+		switch {
+		case !IsSecretProp(k, v):
+		case strings.EqualFold(k, "url"):
+			v, err = encryptURL(v.(string))
+		default:
+			v, err = EncryptSecret(v.(string))
+		}
+		if err != nil {
+			return nil, g.Error(err, "could not encrypt %s", k)
+		}
+		encrypted[k] = v
+	}
+	return encrypted, nil
+}
+
+// DecryptProps returns the properties with the secrets decrypted
+func DecryptProps(props map[string]any) (decrypted map[string]any, err error) {
+	decrypted = make(map[string]any, len(props))
+	for k, v := range props {
+		switch s, _ := v.(string); {
+		case !IsEncrypted(s):
+		case strings.HasPrefix(s, SecretPrefix):
+			v, err = DecryptSecret(s)
+		default:
+			v, err = decryptURL(s)
+		}
+		if err != nil {
+			return nil, g.Error(err, "could not decrypt %s", k)
+		}
+		decrypted[k] = v
+	}
+	return decrypted, nil
+}
+
+// HasEncrypted returns true if one of the properties is encrypted
+func HasEncrypted(props map[string]any) bool {
+	for _, v := range props {
+		if IsEncrypted(v) {
+			return true
+		}
+	}
+	return false
+}
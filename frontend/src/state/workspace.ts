@@ -84,5 +84,7 @@ export interface FileItem {
   path: string
   isDir?: boolean
   modTs?: number
+  hash?: string
+  git?: string
   body?: string
 }
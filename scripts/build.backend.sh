@@ -10,7 +10,7 @@ rm -rf .git
 bash scripts/prep.gomod.sh
 
 # GOOS=darwin GOARCH=amd64 go build -o dbnet-x86_64-apple-darwin
-GOOS=linux GOARCH=amd64 go build -o dbnet-x86_64-unknown-linux-gnu
+GOOS=linux GOARCH=amd64 go build --tags fts5 -o dbnet-x86_64-unknown-linux-gnu
 
 /bin/cp -f dbnet-x86_64-unknown-linux-gnu /__/bin/dbnet
 
@@ -1,3 +1,3 @@
 set -e
 
-DBNET_HOME_DIR=/tmp/dbnet.test go test .
\ No newline at end of file
+DBNET_HOME_DIR=/tmp/dbnet.test go test --tags fts5 .
\ No newline at end of file
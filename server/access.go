@@ -0,0 +1,269 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dbnet-io/dbnet/store"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// AccessLevel is the access of a user on a connection or schema
+type AccessLevel int
+
+const (
+	AccessNone  AccessLevel = iota
+	AccessRead              // SELECT and metadata
+	AccessWrite             // DML
+	AccessAdmin             // DDL and anything else
+)
+
+var accessLevelNames = map[AccessLevel]string{
+	AccessNone:  "none",
+	AccessRead:  "read",
+	AccessWrite: "write",
+	AccessAdmin: "admin",
+}
+
+func (al AccessLevel) String() string {
+	return accessLevelNames[al]
+}
+
+// MarshalText marshals the level as its name
+func (al AccessLevel) MarshalText() ([]byte, error) {
+	return []byte(al.String()), nil
+}
+
+// ParseAccessLevel parses a level name
+func ParseAccessLevel(name string) (al AccessLevel, err error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "read", "read-only", "readonly", "ro":
+		return AccessRead, nil
+	case "write", "read-write", "readwrite", "rw":
+		return AccessWrite, nil
+	case "admin":
+		return AccessAdmin, nil
+	}
+	return AccessNone, g.Error("invalid access level '%s', expected read, write or admin", name)
+}
+
+// SaveGrant validates and saves a grant. The principal is `user:<name>`
+// or `group:<name>`, the connection is a name or `*`, and an empty
+// schema covers all schemas.
+func SaveGrant(grant *store.Grant) (err error) {
+	kind, name, _ := strings.Cut(grant.Principal, ":")
+	if !g.In(kind, "user", "group") || strings.TrimSpace(name) == "" {
+		return g.Error("invalid principal '%s', expected user:<name> or group:<name>", grant.Principal)
+	} else if grant.Conn == "" {
+		return g.Error("missing connection")
+	}
+
+	level, err := ParseAccessLevel(grant.Level)
+	if err != nil {
+		return err
+	}
+
+	grant.Principal = kind + ":" + strings.ToLower(strings.TrimSpace(name))
+	grant.Conn = strings.ToUpper(grant.Conn)
+	grant.Schema = strings.ToLower(grant.Schema)
+	grant.Level = level.String()
+
+	if err = store.Sync("grants", grant); err != nil {
+		return g.Error(err, "could not save grant")
+	}
+	return
+}
+
+// DeleteGrant deletes a grant
+func DeleteGrant(principal, conn, schema string) (err error) {
+	res := store.Db.
+		Where("principal = ? and conn = ? and schema_name = ?", strings.ToLower(principal), strings.ToUpper(conn), strings.ToLower(schema)).
+		Delete(&store.Grant{})
+	if res.Error != nil {
+		return g.Error(res.Error, "could not delete grant")
+	} else if res.RowsAffected == 0 {
+		return g.Error("grant not found for %s on %s", principal, conn)
+	}
+	return
+}
+
+// userGrants returns the grants of the user and its groups on the
+// connection. Access control is off (nil grants) when authentication
+// is disabled, for the token user, or when no grant exists.
+func userGrants(user *AuthUser, conn string) (grants []store.Grant, err error) {
+	if user == nil || user.Provider == "token" {
+		return nil, nil
+	}
+
+	var count int64
+	if err = store.Db.Model(&store.Grant{}).Count(&count).Error; err != nil {
+		return nil, g.Error(err, "could not count grants")
+	} else if count == 0 {
+		return nil, nil
+	}
+
+	principals := []string{"user:" + strings.ToLower(user.Name)}
+	for _, group := range user.Groups {
+		principals = append(principals, "group:"+strings.ToLower(group))
+	}
+
+	grants = []store.Grant{}
+	err = store.Db.Where("principal in ? and conn in ?", principals, []string{strings.ToUpper(conn), "*"}).Find(&grants).Error
+	if err != nil {
+		return nil, g.Error(err, "could not get grants")
+	}
+	return grants, nil
+}
+
+// GetAccessLevel returns the access level of the user on the schema of
+// the connection. An empty schema is the access on all schemas.
+func GetAccessLevel(user *AuthUser, conn, schema string) (level AccessLevel, err error) {
+	grants, err := userGrants(user, conn)
+	if err != nil {
+		return AccessNone, err
+	} else if grants == nil {
+		return AccessAdmin, nil
+	}
+
+	for _, grant := range grants {
+		if grant.Schema != "" && !strings.EqualFold(grant.Schema, schema) {
+			continue
+		}
+		if gLevel, _ := ParseAccessLevel(grant.Level); gLevel > level {
+			level = gLevel
+		}
+	}
+	return
+}
+
+// isOwner returns true if the user is the owner (a user name)
+func isOwner(user *AuthUser, owner string) bool {
+	return user != nil && owner != "" && strings.EqualFold(user.Name, owner)
+}
+
+// CheckAccess returns an error if the user has less than the
+// level on the schema of the connection
+func CheckAccess(user *AuthUser, conn, schema string, level AccessLevel) (err error) {
+	has, err := GetAccessLevel(user, conn, schema)
+	if err != nil {
+		return err
+	} else if has < level {
+		target := conn
+		if schema != "" {
+			target = conn + "." + schema
+		}
+		return g.Error("%s has %s access on %s, %s access is needed", user.Name, has, target, level)
+	}
+	return nil
+}
+
+// CheckSQLAccess returns an error if the user cannot run any statement
+// of the sql text. The targets of a statement need its level, and the
+// sources need read. Unqualified references need the level on all
+// schemas. Statements without references need the level on all
+// schemas, except reads (e.g. `select 1`) which only need a grant on
+// the connection. Strings are read with backslash escapes for the
+// dialects using them, otherwise the text is classified with and
+// without, since both can apply (e.g. postgres E'...' strings, or
+// standard_conforming_strings off), and must be allowed either way.
+func CheckSQLAccess(user *AuthUser, conn, sql string) (err error) {
+	grants, err := userGrants(user, conn)
+	if err != nil || grants == nil {
+		return err
+	}
+
+	modes := []bool{false, true}
+	if connObj, err := dbRestState.DefaultProject().GetConnObject(conn, ""); err == nil && backslashDialects[connObj.Type] {
+		modes = []bool{true}
+	}
+
+	statements := []SQLStatement{}
+	for _, backslash := range modes {
+		stmts, err := ClassifySQL(sql, backslash)
+		if err != nil {
+			return g.Error(err, "could not parse sql")
+		}
+		statements = append(statements, stmts...)
+	}
+
+	for _, stmt := range statements {
+		refs := stmt.Refs
+		if len(refs) == 0 {
+			if stmt.Level == AccessRead {
+				if len(grants) == 0 {
+					return g.Error("%s has no access on %s", user.Name, conn)
+				}
+				continue
+			}
+			refs = []SQLRef{{Schema: "", Level: stmt.Level}}
+		}
+
+		for _, ref := range refs {
+			if err = CheckAccess(user, conn, ref.Schema, ref.Level); err != nil {
+				return g.Error(err, "%s is not allowed", stmt.Keyword)
+			}
+		}
+	}
+	return nil
+}
+
+// sqlAccessMiddleware rejects the submitted SQL if the user does not
+// have the access level it needs. Runs after the parameters are rendered.
+func sqlAccessMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return g.ErrJSON(http.StatusBadRequest, err, "could not read request body")
+		}
+		c.Request().Body = io.NopCloser(strings.NewReader(string(body)))
+
+		if err = CheckSQLAccess(GetAuthUser(c), c.PathParam("connection"), string(body)); err != nil {
+			recordAudit(auditDenied(c, c.PathParam("connection"), string(body), err))
+			return g.ErrJSON(http.StatusForbidden, err)
+		}
+
+		return next(c)
+	}
+}
+
+// tableAccessMiddleware rejects the connection, schema and table
+// requests of users with less than the level on the schema (on all
+// schemas for the connection requests)
+func tableAccessMiddleware(level AccessLevel) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			err = CheckAccess(GetAuthUser(c), c.PathParam("connection"), c.PathParam("schema"), level)
+			if err != nil {
+				return g.ErrJSON(http.StatusForbidden, err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// readableConns returns the connections the user can read, among the
+// given ones, or else among all the connections. Restricted is false
+// when access control is off for the user.
+func readableConns(user *AuthUser, conns []string) (readable []string, restricted bool, err error) {
+	grants, err := userGrants(user, "")
+	if err != nil || grants == nil {
+		return conns, false, err
+	}
+
+	if len(conns) == 0 {
+		for _, entry := range localConns() {
+			conns = append(conns, entry.Name)
+		}
+	}
+
+	readable = []string{}
+	for _, conn := range conns {
+		if CheckAccess(user, conn, "", AccessRead) == nil {
+			readable = append(readable, strings.ToLower(conn))
+		}
+	}
+	return readable, true, nil
+}
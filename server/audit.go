@@ -0,0 +1,249 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dbnet-io/dbnet/store"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/spf13/cast"
+)
+
+// audit actions
+const (
+	AuditSQL         = "sql"
+	AuditSQLCancel   = "sql_cancel"
+	AuditSQLDenied   = "sql_denied"
+	AuditTableWrite  = "table_write"
+	AuditFileWrite   = "file_write"
+	AuditFileDelete  = "file_delete"
+	AuditFileMove    = "file_move"
+	AuditGitStage    = "git_stage"
+	AuditGitCommit   = "git_commit"
+	AuditGitCheckout = "git_checkout"
+	AuditConnAdd     = "conn_add"
+	AuditConnEdit    = "conn_edit"
+	AuditConnRemove  = "conn_remove"
+)
+
+// newAuditEvent returns an event with the user and client IP of the
+// request (see ipExtractor)
+func newAuditEvent(c echo.Context, action string) *store.AuditEvent {
+	event := &store.AuditEvent{
+		Time:         time.Now().Unix(),
+		ClientIP:     c.RealIP(),
+		Action:       action,
+		RowsAffected: -1,
+	}
+	if user := GetAuthUser(c); user != nil {
+		event.User = user.Name
+	}
+	return event
+}
+
+// auditQuery returns the event of a query processed by dbREST
+func auditQuery(c echo.Context, query *dbRestState.Query, start time.Time) *store.AuditEvent {
+	action := AuditSQL
+	if strings.Contains(c.Path(), "/.cancel/") {
+		action = AuditSQLCancel
+	}
+
+	event := newAuditEvent(c, action)
+	event.Time = start.Unix()
+	event.Conn = strings.ToLower(query.Conn)
+	event.Database = strings.ToLower(query.Database)
+	event.QueryID = query.ID
+	event.Text = query.Text
+	event.Status = string(query.Status)
+	event.Err = query.Err
+	event.RowsAffected = query.Affected
+	event.Duration = time.Since(start).Seconds()
+	return event
+}
+
+// tableWriteOperations are the operations of the table write routes, by method
+var tableWriteOperations = map[string]string{
+	http.MethodPost:  "insert",
+	http.MethodPut:   "upsert",
+	http.MethodPatch: "update",
+}
+
+// auditTableWrite returns the event of a table write request (insert,
+// upsert or update of the records of the body). The records are not
+// recorded.
+func auditTableWrite(c echo.Context, start time.Time, body []byte, reqErr error) *store.AuditEvent {
+	event := newAuditEvent(c, AuditTableWrite)
+	event.Time = start.Unix()
+	event.Conn = strings.ToLower(c.PathParam("connection"))
+	event.Database = strings.ToLower(c.QueryParam("database"))
+	event.Text = g.F("%s %s.%s", tableWriteOperations[c.Request().Method], c.PathParam("schema"), c.PathParam("table"))
+	event.Duration = time.Since(start).Seconds()
+	event.Status = "success"
+
+	if status := c.Response().Status; reqErr != nil || status >= 400 {
+		event.Status = "error"
+		if reqErr != nil {
+			event.Err = g.ErrMsgSimple(reqErr)
+		} else {
+			event.Err = strings.TrimSpace(string(body))
+		}
+	} else if payload, err := g.UnmarshalMap(string(body)); err == nil {
+		if affected, ok := payload["affected"]; ok {
+			event.RowsAffected = cast.ToInt64(affected)
+		}
+	}
+	return event
+}
+
+// tableAuditMiddleware records the table write requests
+func tableAuditMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		start := time.Now()
+		capture := &captureWriter{ResponseWriter: c.Response().Writer, max: 64 * 1024}
+		c.Response().Writer = capture
+
+		err = next(c)
+		recordAudit(auditTableWrite(c, start, capture.buf.Bytes(), err))
+		return err
+	}
+}
+
+// auditDenied returns the event of a statement rejected by the access control
+func auditDenied(c echo.Context, conn, sql string, err error) *store.AuditEvent {
+	event := newAuditEvent(c, AuditSQLDenied)
+	event.Conn = strings.ToLower(conn)
+	event.Text = sql
+	event.Status = "denied"
+	event.Err = g.ErrMsgSimple(err)
+	return event
+}
+
+// auditDetachedCancel returns the event of a cancelled detached query
+func auditDetachedCancel(c echo.Context, dq *DetachedQuery) *store.AuditEvent {
+	info := dq.Info()
+	event := newAuditEvent(c, AuditSQLCancel)
+	event.Conn = info.Conn
+	event.Database = info.Database
+	event.QueryID = info.ID
+	event.Text = info.Text
+	event.Status = string(info.Status)
+	return event
+}
+
+// auditFileOperation returns the event of a file change,
+// or nil for the read operations
+func auditFileOperation(c echo.Context, req FileRequest, status string, err error) *store.AuditEvent {
+	action := AuditFileWrite
+	switch req.Operation {
+	case OperationWrite, OperationMkdir, OperationCopy:
+	case OperationDelete:
+		action = AuditFileDelete
+	case OperationRename, OperationMove:
+		action = AuditFileMove
+	default:
+		return nil
+	}
+
+	event := newAuditEvent(c, action)
+	event.Text = req.File.Path
+	if req.Target != "" {
+		event.Text = req.File.Path + " -> " + req.Target
+	}
+	event.Status = status
+	if err != nil {
+		event.Err = g.ErrMsgSimple(err)
+	}
+	return event
+}
+
+// auditGitOperation returns the event of a repository change,
+// or nil for the read operations
+func auditGitOperation(c echo.Context, req GitRequest, status, commit string, err error) *store.AuditEvent {
+	action := AuditGitStage
+	text := strings.Join(req.Files, ", ")
+	switch req.Operation {
+	case GitOperationStage:
+	case GitOperationCommit:
+		action, text = AuditGitCommit, req.Message
+	case GitOperationCheckout:
+		action, text = AuditGitCheckout, req.Branch
+	default:
+		return nil
+	}
+
+	if commit != "" {
+		text = g.F("%s (%s)", text, commit)
+	}
+
+	event := newAuditEvent(c, action)
+	event.Text = req.Path + ": " + text
+	event.Status = status
+	if err != nil {
+		event.Err = g.ErrMsgSimple(err)
+	}
+	return event
+}
+
+// auditConnection returns the event of a connection change. The
+// properties are not recorded (credentials).
+func auditConnection(c echo.Context, action, name string, err error) *store.AuditEvent {
+	event := newAuditEvent(c, action)
+	event.Conn = strings.ToLower(name)
+	event.Status = "success"
+	if err != nil {
+		event.Status = "error"
+		event.Err = g.ErrMsgSimple(err)
+	}
+	return event
+}
+
+// recordAudit appends the event to the audit trail
+func recordAudit(event *store.AuditEvent) {
+	if event == nil {
+		return
+	}
+	g.LogError(store.AddAuditEvent(event), "could not record audit event")
+}
+
+// ParseAuditFilter returns the filter of the export. The from and
+// to values are unix timestamps or date/time strings.
+func ParseAuditFilter(from, to, user, conn, action string) (filter store.AuditFilter, err error) {
+	filter = store.AuditFilter{User: user, Conn: conn, Action: action}
+	if action != "" && !g.In(action, AuditSQL, AuditSQLCancel, AuditSQLDenied, AuditTableWrite, AuditFileWrite, AuditFileDelete, AuditFileMove, AuditGitStage, AuditGitCommit, AuditGitCheckout, AuditConnAdd, AuditConnEdit, AuditConnRemove) {
+		return filter, g.Error("invalid audit action: %s", action)
+	}
+	if filter.From, err = parseTimestamp(from); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseTimestamp(to); err != nil {
+		return filter, err
+	}
+	return
+}
+
+// GetAuditEvents exports the audit trail as JSON lines. Filtered with
+// the `from`, `to`, `user`, `conn` and `action` query parameters.
+// Needs admin access on all connections when grants exist.
+func GetAuditEvents(c echo.Context) (err error) {
+	if err = CheckAccess(GetAuthUser(c), "*", "", AccessAdmin); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "not allowed to export the audit log")
+	}
+
+	filter, err := ParseAuditFilter(
+		c.QueryParam("from"), c.QueryParam("to"),
+		c.QueryParam("user"), c.QueryParam("conn"), c.QueryParam("action"),
+	)
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid audit filter")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/jsonlines")
+	c.Response().WriteHeader(http.StatusOK)
+	if _, err = store.ExportAuditEvents(c.Response(), filter); err != nil {
+		g.LogError(err, "could not export audit events")
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/dbnet-io/dbnet/store"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/spf13/cast"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SessionCookieName is the name of the session cookie
+const SessionCookieName = "dbnet_session"
+
+// AuthUser is the authenticated user of a request
+type AuthUser struct {
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	Provider string   `json:"provider"` // password, token or oidc
+}
+
+// AuthConfig is the authentication configuration, from the
+// environment variables or the `variables` section of the env file.
+// Authentication is enabled when a local user exists, or when a token
+// or OIDC issuer is set.
+type AuthConfig struct {
+	Token        string     // DBNET_AUTH_TOKEN
+	SessionHours int        // DBNET_AUTH_SESSION_HOURS (default: 168)
+	OIDC         OIDCConfig // DBNET_AUTH_OIDC_*
+}
+
+// Auth is the authentication configuration of the server
+var Auth = AuthConfig{}
+
+// LoadAuthConfig loads the authentication configuration
+func LoadAuthConfig() (ac AuthConfig) {
+	ac.Token = env.GetVar("DBNET_AUTH_TOKEN")
+	ac.SessionHours = cast.ToInt(env.GetVar("DBNET_AUTH_SESSION_HOURS"))
+	if ac.SessionHours <= 0 {
+		ac.SessionHours = 7 * 24
+	}
+
+	ac.OIDC = OIDCConfig{
+		Issuer:       strings.TrimSuffix(env.GetVar("DBNET_AUTH_OIDC_ISSUER"), "/"),
+		ClientID:     env.GetVar("DBNET_AUTH_OIDC_CLIENT_ID"),
+		ClientSecret: env.GetVar("DBNET_AUTH_OIDC_CLIENT_SECRET"),
+		RedirectURL:  env.GetVar("DBNET_AUTH_OIDC_REDIRECT_URL"),
+		UserClaim:    env.GetVar("DBNET_AUTH_OIDC_USER_CLAIM"),
+		GroupsClaim:  env.GetVar("DBNET_AUTH_OIDC_GROUPS_CLAIM"),
+	}
+	if ac.OIDC.UserClaim == "" {
+		ac.OIDC.UserClaim = "email"
+	}
+	if ac.OIDC.GroupsClaim == "" {
+		ac.OIDC.GroupsClaim = "groups"
+	}
+	return
+}
+
+// usersCache caches whether local users exist, checked on every request.
+// Users added by another process (`dbnet users add`) are seen after usersCacheTTL.
+var usersCache struct {
+	has       bool
+	checkedAt time.Time
+	mux       sync.Mutex
+}
+
+const usersCacheTTL = 10 * time.Second
+
+// HasUsers returns true if local users exist
+func (ac AuthConfig) HasUsers() bool {
+	usersCache.mux.Lock()
+	defer usersCache.mux.Unlock()
+
+	if time.Since(usersCache.checkedAt) > usersCacheTTL {
+		var count int64
+		if err := store.Db.Model(&store.User{}).Count(&count).Error; err != nil {
+			g.LogError(err, "could not count users")
+			return usersCache.has
+		}
+		usersCache.has = count > 0
+		usersCache.checkedAt = time.Now()
+	}
+	return usersCache.has
+}
+
+// resetUsersCache makes the next HasUsers check the database
+func resetUsersCache() {
+	usersCache.mux.Lock()
+	usersCache.checkedAt = time.Time{}
+	usersCache.mux.Unlock()
+}
+
+// Enabled returns true if requests must be authenticated
+func (ac AuthConfig) Enabled() bool {
+	return ac.Token != "" || ac.OIDC.Issuer != "" || ac.HasUsers()
+}
+
+// publicPaths are the routes accessible without authentication:
+// the embedded app files and the login routes
+var publicPaths = map[string]bool{
+	RouteIndex.String() + "*": true,
+	"/static/:folder/:name":   true,
+	"/assets/:name":           true,
+	"/assets/:folder/:name":   true,
+}
+
+// authMiddleware rejects unauthenticated requests when authentication
+// is enabled. The user is set in the context as `user`.
+func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		if publicPaths[c.Path()] || strings.HasPrefix(c.Path(), "/auth/") {
+			if user, err := authenticate(c); err == nil {
+				c.Set("user", user)
+			}
+			return next(c)
+		}
+
+		if !Auth.Enabled() {
+			return next(c)
+		}
+
+		user, err := authenticate(c)
+		if err != nil {
+			return g.ErrJSON(http.StatusUnauthorized, err)
+		}
+		c.Set("user", user)
+
+		return next(c)
+	}
+}
+
+// authenticate returns the user of the bearer token or session cookie
+func authenticate(c echo.Context) (user *AuthUser, err error) {
+	token := ""
+	if header := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if cookie, err := c.Cookie(SessionCookieName); err == nil {
+		token = cookie.Value
+	}
+
+	if token == "" {
+		return nil, g.Error("not authenticated")
+	}
+
+	if user = checkToken(token); user != nil {
+		return user, nil
+	}
+
+	session := store.AuthSession{}
+	err = store.Db.Where("token_hash = ?", hashToken(token)).Limit(1).Find(&session).Error
+	if err != nil {
+		return nil, g.Error(err, "could not get session")
+	} else if session.User == "" || session.ExpiresAt < time.Now().Unix() {
+		return nil, g.Error("invalid or expired session")
+	}
+
+	return &AuthUser{Name: session.User, Groups: session.Groups, Provider: session.Provider}, nil
+}
+
+// checkToken returns the token user if the token matches DBNET_AUTH_TOKEN
+func checkToken(token string) *AuthUser {
+	if Auth.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(Auth.Token)) == 1 {
+		return &AuthUser{Name: "token", Groups: []string{}, Provider: "token"}
+	}
+	return nil
+}
+
+// GetAuthUser returns the authenticated user of the request,
+// or nil if authentication is disabled
+func GetAuthUser(c echo.Context) *AuthUser {
+	if user, ok := c.Get("user").(*AuthUser); ok {
+		return user
+	}
+	return nil
+}
+
+// NewSession creates a session for the user and sets the session cookie
+func NewSession(c echo.Context, user AuthUser) (err error) {
+	token := randomToken()
+	expires := time.Now().Add(time.Duration(Auth.SessionHours) * time.Hour)
+
+	session := store.AuthSession{
+		TokenHash: hashToken(token),
+		User:      user.Name,
+		Groups:    user.Groups,
+		Provider:  user.Provider,
+		ExpiresAt: expires.Unix(),
+	}
+	if session.Groups == nil {
+		session.Groups = store.Tags{}
+	}
+	if err = store.Sync("auth_sessions", &session); err != nil {
+		return g.Error(err, "could not save session")
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return
+}
+
+// EndSession deletes the session of the request and clears the cookie
+func EndSession(c echo.Context) (err error) {
+	if cookie, err := c.Cookie(SessionCookieName); err == nil {
+		err = store.Db.Where("token_hash = ?", hashToken(cookie.Value)).Delete(&store.AuthSession{}).Error
+		if err != nil {
+			return g.Error(err, "could not delete session")
+		}
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// CheckPassword returns the local user if the password matches
+func CheckPassword(name, password string) (user *AuthUser, err error) {
+	u := store.User{}
+	err = store.Db.Where("name = ?", strings.ToLower(name)).Limit(1).Find(&u).Error
+	if err != nil {
+		return nil, g.Error(err, "could not get user")
+	} else if u.Name == "" {
+		// same cost as a wrong password
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, g.Error("invalid username or password")
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, g.Error("invalid username or password")
+	}
+
+	return &AuthUser{Name: u.Name, Groups: u.Groups, Provider: "password"}, nil
+}
+
+// GeneratePassword returns a random password
+func GeneratePassword() string {
+	return randomToken()[:20]
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// SaveUser creates or updates a local user. The password is
+// not changed if empty.
+func SaveUser(name, password string, groups []string) (err error) {
+	user := store.User{}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return g.Error("missing user name")
+	} else if name == "token" {
+		return g.Error("user name 'token' is reserved")
+	}
+
+	err = store.Db.Where("name = ?", name).Limit(1).Find(&user).Error
+	if err != nil {
+		return g.Error(err, "could not get user")
+	}
+
+	if user.Name == "" && password == "" {
+		return g.Error("missing password for new user %s", name)
+	} else if user.Name == "" {
+		// log out the OIDC users of the same name, which would share its grants
+		err = store.Db.Where("lower(user) = ? and provider = ?", name, "oidc").Delete(&store.AuthSession{}).Error
+		if err != nil {
+			return g.Error(err, "could not delete sessions of %s", name)
+		}
+	}
+
+	user.Name = name
+	if groups != nil {
+		user.Groups = groups
+	} else if user.Groups == nil {
+		user.Groups = store.Tags{}
+	}
+
+	if password != "" {
+		if len(password) < 8 {
+			return g.Error("password must have at least 8 characters")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return g.Error(err, "could not hash password")
+		}
+		user.PasswordHash = string(hash)
+
+		// log out existing sessions
+		err = store.Db.Where("user = ? and provider = ?", name, "password").Delete(&store.AuthSession{}).Error
+		if err != nil {
+			return g.Error(err, "could not delete sessions of %s", name)
+		}
+	}
+
+	defer resetUsersCache()
+	return store.Sync("users", &user)
+}
+
+// DeleteUser deletes a local user and its sessions
+func DeleteUser(name string) (err error) {
+	name = strings.ToLower(name)
+	defer resetUsersCache()
+	res := store.Db.Where("name = ?", name).Delete(&store.User{})
+	if res.Error != nil {
+		return g.Error(res.Error, "could not delete user %s", name)
+	} else if res.RowsAffected == 0 {
+		return g.Error("user %s not found", name)
+	}
+
+	err = store.Db.Where("user = ? and provider = ?", name, "password").Delete(&store.AuthSession{}).Error
+	if err != nil {
+		return g.Error(err, "could not delete sessions of %s", name)
+	}
+	return
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// loginLimiter limits the failed login attempts per client IP
+type loginLimiter struct {
+	failures map[string][]time.Time
+	mux      sync.Mutex
+}
+
+var failedLogins = &loginLimiter{failures: map[string][]time.Time{}}
+
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 5 * time.Minute
+)
+
+// Allowed returns false if the IP has too many recent failures
+func (ll *loginLimiter) Allowed(ip string) bool {
+	ll.mux.Lock()
+	defer ll.mux.Unlock()
+
+	recent := []time.Time{}
+	for _, t := range ll.failures[ip] {
+		if time.Since(t) < loginFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(ll.failures, ip)
+	} else {
+		ll.failures[ip] = recent
+	}
+	return len(recent) < maxLoginFailures
+}
+
+// Fail records a failure for the IP, and forgets the IPs
+// without recent failures
+func (ll *loginLimiter) Fail(ip string) {
+	ll.mux.Lock()
+	defer ll.mux.Unlock()
+
+	for key, times := range ll.failures {
+		if time.Since(times[len(times)-1]) >= loginFailureWindow {
+			delete(ll.failures, key)
+		}
+	}
+	ll.failures[ip] = append(ll.failures[ip], time.Now())
+}
+
+// ipExtractor returns the client IP of the requests: the connection
+// address, or the X-Forwarded-For address set by one of the proxies
+// in DBNET_TRUSTED_PROXIES (IPs or CIDR ranges)
+func ipExtractor() echo.IPExtractor {
+	proxies := splitList(env.GetVar("DBNET_TRUSTED_PROXIES"))
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			g.Warn("invalid trusted proxy %s: %s", proxy, err.Error())
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
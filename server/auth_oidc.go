@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/store"
+	"github.com/flarco/g"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cast"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig is the OpenID Connect provider configuration
+type OIDCConfig struct {
+	Issuer       string // DBNET_AUTH_OIDC_ISSUER
+	ClientID     string // DBNET_AUTH_OIDC_CLIENT_ID
+	ClientSecret string // DBNET_AUTH_OIDC_CLIENT_SECRET
+	RedirectURL  string // DBNET_AUTH_OIDC_REDIRECT_URL (default: <host>/auth/oidc/callback)
+	UserClaim    string // DBNET_AUTH_OIDC_USER_CLAIM (default: email)
+	GroupsClaim  string // DBNET_AUTH_OIDC_GROUPS_CLAIM (default: groups)
+}
+
+// OIDCProvider authenticates users with the authorization code flow (with PKCE)
+type OIDCProvider struct {
+	Config   OIDCConfig
+	Metadata struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+
+	keys        map[string]any // public keys by kid
+	keysFetched time.Time
+	pending     map[string]oidcPending // by state
+	mux         sync.Mutex
+}
+
+// oidcPending is a login waiting for the provider callback
+type oidcPending struct {
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// oidcStateCookieName is the cookie binding the login state to the browser
+const oidcStateCookieName = "dbnet_oidc_state"
+
+// oidcStateTTL is the time to complete a login with the provider
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	oidcProvider    *OIDCProvider
+	oidcProviderMux sync.Mutex
+)
+
+// GetOIDCProvider returns the provider of the configuration,
+// discovering its endpoints on first use
+func GetOIDCProvider() (p *OIDCProvider, err error) {
+	oidcProviderMux.Lock()
+	defer oidcProviderMux.Unlock()
+
+	if Auth.OIDC.Issuer == "" {
+		return nil, g.Error("OIDC is not configured")
+	} else if oidcProvider != nil && oidcProvider.Config == Auth.OIDC {
+		return oidcProvider, nil
+	}
+
+	p = &OIDCProvider{Config: Auth.OIDC, pending: map[string]oidcPending{}}
+	if err = p.discover(); err != nil {
+		return nil, err
+	}
+	oidcProvider = p
+	return
+}
+
+// discover fetches the provider metadata
+func (p *OIDCProvider) discover() (err error) {
+	err = getJSON(p.Config.Issuer+"/.well-known/openid-configuration", &p.Metadata)
+	if err != nil {
+		return g.Error(err, "could not discover OIDC provider %s", p.Config.Issuer)
+	} else if p.Metadata.Issuer != p.Config.Issuer {
+		return g.Error("OIDC issuer mismatch: expected %s, got %s", p.Config.Issuer, p.Metadata.Issuer)
+	} else if p.Metadata.AuthorizationEndpoint == "" || p.Metadata.TokenEndpoint == "" || p.Metadata.JwksURI == "" {
+		return g.Error("incomplete OIDC provider metadata for %s", p.Config.Issuer)
+	}
+	return
+}
+
+// oauth2Config returns the client configuration
+func (p *OIDCProvider) oauth2Config(redirectURL string) *oauth2.Config {
+	if p.Config.RedirectURL != "" {
+		redirectURL = p.Config.RedirectURL
+	}
+	return &oauth2.Config{
+		ClientID:     p.Config.ClientID,
+		ClientSecret: p.Config.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.Metadata.AuthorizationEndpoint,
+			TokenURL: p.Metadata.TokenEndpoint,
+		},
+	}
+}
+
+// AuthCodeURL starts a login and returns the URL to redirect to, with
+// its state, to be checked against the browser on callback
+func (p *OIDCProvider) AuthCodeURL(redirectURL string) (url, state string) {
+	state, nonce, verifier := randomToken(), randomToken(), oauth2.GenerateVerifier()
+
+	p.mux.Lock()
+	for k, pending := range p.pending {
+		if time.Now().After(pending.Expires) {
+			delete(p.pending, k)
+		}
+	}
+	p.pending[state] = oidcPending{Nonce: nonce, Verifier: verifier, Expires: time.Now().Add(oidcStateTTL)}
+	p.mux.Unlock()
+
+	url = p.oauth2Config(redirectURL).AuthCodeURL(
+		state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.S256ChallengeOption(verifier),
+	)
+	return url, state
+}
+
+// Exchange completes the login with the callback code,
+// and returns the user of the verified ID token
+func (p *OIDCProvider) Exchange(redirectURL, state, code string) (user *AuthUser, err error) {
+	p.mux.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mux.Unlock()
+
+	if !ok || time.Now().After(pending.Expires) {
+		return nil, g.Error("invalid or expired login state")
+	}
+
+	token, err := p.oauth2Config(redirectURL).Exchange(
+		context.Background(), code, oauth2.VerifierOption(pending.Verifier),
+	)
+	if err != nil {
+		return nil, g.Error(err, "could not exchange OIDC code")
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, g.Error("no id_token in OIDC token response")
+	}
+
+	claims, err := p.Verify(rawIDToken, pending.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user = &AuthUser{Groups: []string{}, Provider: "oidc"}
+	for _, claim := range []string{p.Config.UserClaim, "preferred_username", "sub"} {
+		if user.Name = cast.ToString(claims[claim]); user.Name != "" {
+			break
+		}
+	}
+	switch groups := claims[p.Config.GroupsClaim].(type) {
+	case []any:
+		user.Groups = cast.ToStringSlice(groups)
+	case string:
+		user.Groups = []string{groups}
+	}
+
+	return user, nil
+}
+
+// checkOIDCName returns an error if the OIDC user name is reserved or
+// taken by a local user, whose grants and queries it would share
+func checkOIDCName(name string) (err error) {
+	name = strings.ToLower(name)
+	if name == "token" {
+		return g.Error("user name 'token' is reserved")
+	}
+
+	var count int64
+	if err = store.Db.Model(&store.User{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return g.Error(err, "could not get user")
+	} else if count > 0 {
+		return g.Error("user name %s is taken by a local user", name)
+	}
+	return nil
+}
+
+// Verify verifies the signature and claims of the ID token
+func (p *OIDCProvider) Verify(rawIDToken, nonce string) (claims jwt.MapClaims, err error) {
+	claims = jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(
+		rawIDToken, claims, p.keyFunc,
+		jwt.WithIssuer(p.Config.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+	)
+	if err != nil {
+		return nil, g.Error(err, "invalid OIDC id_token")
+	}
+
+	if cast.ToString(claims["nonce"]) != nonce {
+		return nil, g.Error("invalid OIDC id_token nonce")
+	}
+	return claims, nil
+}
+
+// keyFunc returns the public key of the token, refreshing the
+// keys at most once a minute when the key ID is unknown (rotation)
+func (p *OIDCProvider) keyFunc(token *jwt.Token) (any, error) {
+	kid := cast.ToString(token.Header["kid"])
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	} else if time.Since(p.keysFetched) < time.Minute {
+		return nil, g.Error("unknown key id '%s'", kid)
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := getJSON(p.Metadata.JwksURI, &jwks); err != nil {
+		return nil, g.Error(err, "could not fetch OIDC keys")
+	}
+
+	p.keys = map[string]any{}
+	p.keysFetched = time.Now()
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, g.Error("unknown key id '%s'", kid)
+}
+
+// getJSON fetches and decodes a JSON document
+func getJSON(url string, v any) (err error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return g.Error(err, "could not get %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return g.Error("could not get %s: status %d", url, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return g.Error(err, "could not decode %s", url)
+	}
+	return
+}
+
+// randomToken returns a random url-safe string
+func randomToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		g.LogFatal(err, "could not generate random token")
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
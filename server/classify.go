@@ -0,0 +1,430 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/flarco/g"
+	"github.com/slingdata-io/sling-cli/core/dbio"
+)
+
+// SQLStatement is a statement classified by the access it needs
+type SQLStatement struct {
+	Keyword string      `json:"keyword"` // the keyword requiring the level, e.g. DELETE
+	Level   AccessLevel `json:"level"`
+	Refs    []SQLRef    `json:"refs"` // the referenced objects
+}
+
+// SQLRef is an object referenced by a statement
+type SQLRef struct {
+	Schema string      `json:"schema"` // empty if unqualified
+	Level  AccessLevel `json:"level"`  // read for sources, the statement level for targets
+}
+
+// statementLevels are the levels needed by the first keyword of a
+// statement. Any other statement (DDL, procedure calls, session
+// settings...) needs admin.
+var statementLevels = map[string]AccessLevel{
+	"SELECT":   AccessRead,
+	"WITH":     AccessRead,
+	"VALUES":   AccessRead,
+	"TABLE":    AccessRead,
+	"SHOW":     AccessRead,
+	"DESCRIBE": AccessRead,
+	"DESC":     AccessRead,
+	"EXPLAIN":  AccessRead,
+	"USE":      AccessRead,
+	"BEGIN":    AccessRead,
+	"START":    AccessRead,
+	"COMMIT":   AccessRead,
+	"ROLLBACK": AccessRead,
+	"END":      AccessRead,
+	"INSERT":   AccessWrite,
+	"UPDATE":   AccessWrite,
+	"DELETE":   AccessWrite,
+	"MERGE":    AccessWrite,
+	"UPSERT":   AccessWrite,
+	"REPLACE":  AccessWrite,
+	"COPY":     AccessWrite,
+	"LOAD":     AccessWrite,
+}
+
+// nestedLevels are the keywords raising the level of a statement
+// wherever they appear, e.g. in a CTE or with EXPLAIN ANALYZE
+var nestedLevels = map[string]AccessLevel{
+	"INSERT":   AccessWrite,
+	"UPDATE":   AccessWrite,
+	"DELETE":   AccessWrite,
+	"MERGE":    AccessWrite,
+	"CREATE":   AccessAdmin,
+	"DROP":     AccessAdmin,
+	"ALTER":    AccessAdmin,
+	"TRUNCATE": AccessAdmin,
+	"GRANT":    AccessAdmin,
+	"REVOKE":   AccessAdmin,
+}
+
+// refKeywords are followed by object references, true for the
+// targets of the statement, false for the sources (read)
+var refKeywords = map[string]bool{
+	"FROM": false, "JOIN": false, "USING": false,
+	"INTO": true, "UPDATE": true, "TABLE": true, "TRUNCATE": true, "COPY": true,
+	"VIEW": true, "SEQUENCE": true, "FUNCTION": true, "PROCEDURE": true, "SCHEMA": true,
+}
+
+// refModifiers may be between a reference keyword and the reference
+var refModifiers = map[string]bool{
+	"IF": true, "NOT": true, "EXISTS": true, "ONLY": true, "LATERAL": true,
+}
+
+// aliasStops are the keywords which cannot be an alias after a reference
+var aliasStops = map[string]bool{
+	"WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true,
+	"FULL": true, "CROSS": true, "OUTER": true, "NATURAL": true, "ON": true,
+	"USING": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true,
+	"OFFSET": true, "UNION": true, "EXCEPT": true, "INTERSECT": true, "SET": true,
+	"VALUES": true, "SELECT": true, "WINDOW": true, "FETCH": true, "FOR": true,
+	"RETURNING": true, "QUALIFY": true, "WHEN": true, "AS": true,
+}
+
+// ClassifySQL splits the sql text into statements, and classifies
+// each by the access level it needs and the schemas it references.
+// Comments, string literals and quoted identifiers are handled, so a
+// keyword in a string does not change the level. With backslash, a
+// backslash escapes the next character in strings (e.g. MySQL).
+// Returns an error for an unterminated string, identifier or comment.
+func ClassifySQL(sql string, backslash bool) (statements []SQLStatement, err error) {
+	tokens, err := tokenizeSQL(sql, backslash)
+	if err != nil {
+		return nil, err
+	}
+
+	statements = []SQLStatement{}
+	for _, stmtTokens := range splitStatements(tokens) {
+		statements = append(statements, classifyStatement(stmtTokens))
+	}
+	return
+}
+
+// backslashDialects are the connection types whose string
+// literals escape characters with a backslash by default
+var backslashDialects = map[dbio.Type]bool{
+	dbio.TypeDbMySQL:      true,
+	dbio.TypeDbMariaDB:    true,
+	dbio.TypeDbStarRocks:  true,
+	dbio.TypeDbBigQuery:   true,
+	dbio.TypeDbSnowflake:  true,
+	dbio.TypeDbClickhouse: true,
+	dbio.TypeDbProton:     true,
+	dbio.TypeDbRedshift:   true,
+}
+
+func classifyStatement(tokens []sqlToken) (stmt SQLStatement) {
+	stmt = SQLStatement{Keyword: tokens[0].Upper(), Level: AccessAdmin, Refs: []SQLRef{}}
+	if tokens[0].Kind == tokenWord {
+		if level, ok := statementLevels[stmt.Keyword]; ok {
+			stmt.Level = level
+		}
+	}
+
+	targets := map[int]bool{} // indexes of the target refs
+	addRef := func(parts []string, isSchema, isTarget bool) {
+		ref := SQLRef{Level: AccessRead}
+		if isSchema {
+			ref.Schema = parts[len(parts)-1]
+		} else if len(parts) >= 2 {
+			ref.Schema = parts[len(parts)-2]
+		}
+		if isTarget {
+			targets[len(stmt.Refs)] = true
+		}
+		stmt.Refs = append(stmt.Refs, ref)
+	}
+
+	// true for the parentheses of a subquery, false for expressions
+	queryContext := []bool{true}
+	inserting := false
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.Kind == tokenPunct {
+			switch token.Text {
+			case "(":
+				next := ""
+				if i+1 < len(tokens) {
+					next = tokens[i+1].Upper()
+				}
+				queryContext = append(queryContext, g.In(next, "SELECT", "WITH", "VALUES", "INSERT", "UPDATE", "DELETE", "MERGE"))
+			case ")":
+				if len(queryContext) > 1 {
+					queryContext = queryContext[:len(queryContext)-1]
+				}
+			}
+			continue
+		} else if token.Kind != tokenWord {
+			continue
+		}
+
+		keyword := token.Upper()
+		prev := ""
+		if i > 0 {
+			prev = tokens[i-1].Upper()
+		}
+
+		if level, ok := nestedLevels[keyword]; ok && level > stmt.Level {
+			// SELECT ... FOR UPDATE and FK actions do not modify data
+			if !(keyword == "UPDATE" && (prev == "FOR" || prev == "ON")) && !(keyword == "DELETE" && prev == "ON") {
+				stmt.Level = level
+				stmt.Keyword = keyword
+			}
+		}
+		if keyword == "PROGRAM" && (prev == "TO" || prev == "FROM") && stmt.Level < AccessAdmin {
+			// COPY ... TO PROGRAM runs a shell command on the server
+			stmt.Level = AccessAdmin
+			stmt.Keyword = "COPY PROGRAM"
+		}
+		if keyword == "INSERT" || keyword == "MERGE" || keyword == "REPLACE" {
+			inserting = true
+		} else if keyword == "INTO" && !inserting && stmt.Level < AccessAdmin {
+			// SELECT ... INTO creates a table
+			stmt.Level = AccessAdmin
+			stmt.Keyword = "SELECT INTO"
+		}
+
+		isTarget, isRef := refKeywords[keyword]
+		if !isRef || !queryContext[len(queryContext)-1] {
+			continue
+		} else if keyword == "UPDATE" && (prev == "FOR" || prev == "ON") {
+			continue
+		} else if keyword == "FROM" && prev == "DELETE" {
+			isTarget = true
+		}
+
+		// read the references, separated by commas for FROM lists
+		for j := i + 1; j < len(tokens); {
+			for j < len(tokens) && refModifiers[tokens[j].Upper()] {
+				j++
+			}
+			parts, next := readIdentifier(tokens, j)
+			if len(parts) == 0 {
+				break
+			} else if next < len(tokens) && tokens[next].Text == "(" && len(parts) == 1 && keyword != "INTO" && keyword != "TABLE" {
+				break // function call, e.g. generate_series(...)
+			}
+			addRef(parts, keyword == "SCHEMA", isTarget)
+			j = next
+
+			if keyword != "FROM" {
+				break
+			}
+
+			// skip the alias
+			if j < len(tokens) && tokens[j].Upper() == "AS" {
+				j++
+			}
+			if j < len(tokens) && tokens[j].Kind != tokenPunct && !aliasStops[tokens[j].Upper()] {
+				j++
+			}
+			if j < len(tokens) && tokens[j].Text == "," {
+				j++
+				continue
+			}
+			break
+		}
+	}
+
+	for i := range stmt.Refs {
+		if targets[i] {
+			stmt.Refs[i].Level = stmt.Level
+		}
+	}
+
+	return stmt
+}
+
+// readIdentifier reads a dotted identifier from position i, returning its
+// parts and the position after it
+func readIdentifier(tokens []sqlToken, i int) (parts []string, next int) {
+	for i < len(tokens) {
+		token := tokens[i]
+		if token.Kind != tokenWord && token.Kind != tokenQuoted {
+			break
+		} else if token.Kind == tokenWord && aliasStops[token.Upper()] {
+			break
+		}
+		parts = append(parts, token.Text)
+		i++
+		if i < len(tokens) && tokens[i].Text == "." {
+			i++
+			continue
+		}
+		break
+	}
+	return parts, i
+}
+
+type sqlTokenKind int
+
+const (
+	tokenWord sqlTokenKind = iota
+	tokenQuoted
+	tokenString
+	tokenPunct
+	tokenComment
+)
+
+type sqlToken struct {
+	Kind  sqlTokenKind
+	Text  string
+	Start int // position in the sql text
+	End   int // position after the token
+}
+
+// Upper returns the upper-cased text of a word, otherwise the text
+func (t sqlToken) Upper() string {
+	if t.Kind == tokenWord {
+		return strings.ToUpper(t.Text)
+	}
+	return t.Text
+}
+
+// tokenizeSQL splits sql into words, quoted identifiers, string
+// literals, comments and punctuation, skipping whitespace. With
+// backslash, a backslash escapes the next character in strings.
+// Postgres E'...' strings always do.
+func tokenizeSQL(sql string, backslash bool) (tokens []sqlToken, err error) {
+	isWordChar := func(c byte) bool {
+		return c == '_' || c == '$' || c == '@' || c == '#' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+	}
+
+	// readUntil returns the position after the closing delimiter,
+	// skipping doubled delimiters (e.g. 'it''s') and escaped characters.
+	// Returns -1 if not closed.
+	readUntil := func(i int, end string, doubled, escaped bool) int {
+		for i < len(sql) {
+			if escaped && sql[i] == '\\' {
+				i += 2
+				continue
+			} else if !strings.HasPrefix(sql[i:], end) {
+				i++
+				continue
+			}
+			i += len(end)
+			if doubled && strings.HasPrefix(sql[i:], end) {
+				i += len(end)
+				continue
+			}
+			return i
+		}
+		return -1
+	}
+
+	add := func(kind sqlTokenKind, text string, start, end int) {
+		tokens = append(tokens, sqlToken{Kind: kind, Text: text, Start: start, End: end})
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := readUntil(i, "\n", false, false)
+			if end < 0 {
+				end = len(sql)
+			}
+			add(tokenComment, sql[i:end], i, end)
+			i = end
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := readUntil(i+2, "*/", false, false)
+			if end < 0 {
+				return nil, g.Error("unterminated comment at position %d", i)
+			}
+			add(tokenComment, sql[i:end], i, end)
+			i = end
+		case c == '\'' || (c == 'E' || c == 'e') && strings.HasPrefix(sql[i+1:], "'") && (i == 0 || !isWordChar(sql[i-1])):
+			start := i
+			if c != '\'' {
+				i++ // postgres escape string
+			}
+			end := readUntil(i+1, "'", true, backslash || c != '\'')
+			if end < 0 {
+				return nil, g.Error("unterminated string at position %d", start)
+			}
+			add(tokenString, sql[start:end], start, end)
+			i = end
+		case c == '"' || c == '`':
+			end := readUntil(i+1, string(c), true, backslash && c == '"')
+			if end < 0 {
+				return nil, g.Error("unterminated quoted identifier at position %d", i)
+			}
+			text := strings.TrimSuffix(sql[i+1:end], string(c))
+			add(tokenQuoted, strings.ReplaceAll(text, string(c)+string(c), string(c)), i, end)
+			i = end
+		case c == '[' && (len(tokens) == 0 || tokens[len(tokens)-1].Kind == tokenPunct || tokens[len(tokens)-1].Kind == tokenWord && refKeywords[tokens[len(tokens)-1].Upper()]):
+			// sql server quoted identifier (not an array index)
+			end := readUntil(i+1, "]", true, false)
+			if end < 0 {
+				return nil, g.Error("unterminated quoted identifier at position %d", i)
+			}
+			add(tokenQuoted, strings.TrimSuffix(sql[i+1:end], "]"), i, end)
+			i = end
+		case c == '$' && dollarTag(sql[i:]) != "":
+			// postgres dollar-quoted string
+			tag := dollarTag(sql[i:])
+			end := readUntil(i+len(tag), tag, false, false)
+			if end < 0 {
+				return nil, g.Error("unterminated dollar-quoted string at position %d", i)
+			}
+			add(tokenString, sql[i:end], i, end)
+			i = end
+		case isWordChar(c):
+			j := i
+			for j < len(sql) && isWordChar(sql[j]) {
+				j++
+			}
+			add(tokenWord, sql[i:j], i, j)
+			i = j
+		default:
+			add(tokenPunct, string(c), i, i+1)
+			i++
+		}
+	}
+	return
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string
+// (e.g. `$$` or `$body$`), or empty
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		} else if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 1 && c >= '0' && c <= '9')) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// splitStatements splits the tokens on semicolons, dropping comments
+// and empty statements
+func splitStatements(tokens []sqlToken) (statements [][]sqlToken) {
+	current := []sqlToken{}
+	for _, token := range tokens {
+		if token.Kind == tokenComment {
+			continue
+		} else if token.Kind == tokenPunct && token.Text == ";" {
+			if len(current) > 0 {
+				statements = append(statements, current)
+			}
+			current = []sqlToken{}
+			continue
+		}
+		current = append(current, token)
+	}
+	if len(current) > 0 {
+		statements = append(statements, current)
+	}
+	return
+}
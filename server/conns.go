@@ -0,0 +1,481 @@
+package server
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dbnet-io/dbnet/env"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/slingdata-io/sling-cli/core/dbio"
+	"github.com/slingdata-io/sling-cli/core/dbio/connection"
+	"github.com/slingdata-io/sling-cli/core/dbio/database"
+	"github.com/spf13/cast"
+)
+
+// ConnRequest is the request struct to add or edit a connection of the
+// dbNet env file. The properties are the ones of the env file (e.g.
+// `type`, `host`, `user`), and can be combined with a URL. When editing,
+// the properties are merged into the existing ones, a null removes one.
+type ConnRequest struct {
+	Name     string         `json:"name" query:"name"`
+	URL      string         `json:"url" query:"url"`
+	Props    map[string]any `json:"props" query:"props"`
+	SkipTest bool           `json:"skip_test" query:"skip_test"` // save without testing the connection
+}
+
+// connNameRegex is the format of the connection names
+var connNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// serverOnlyProps are the properties which can only be set in the env
+// file, as they use the files and the SSH agent of the server
+var serverOnlyProps = []string{"tunnel_key_file", "tunnel_agent"}
+
+// checkAPI returns an error if the request, coming from the server
+// API, sets a server-only property or references an env variable.
+// Variables are expanded when the env file is loaded, which would
+// reveal the environment of the server.
+func (r *ConnRequest) checkAPI() (err error) {
+	values := []any{r.URL}
+	for k, v := range r.Props {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if g.In(k, serverOnlyProps...) && v != nil {
+			return g.Error("property %s can only be set in %s", k, env.HomeDirEnvFile)
+		}
+		values = append(values, v)
+	}
+
+	for _, v := range values {
+		if s, ok := v.(string); ok && strings.Contains(s, "${") {
+			return g.Error("env variables can only be referenced in %s", env.HomeDirEnvFile)
+		}
+	}
+	return nil
+}
+
+// merge returns the properties of the connection, from the current ones
+func (r *ConnRequest) merge(current map[string]any) (props map[string]any) {
+	props = map[string]any{}
+	for k, v := range current {
+		props[k] = v
+	}
+	for k, v := range r.Props {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if v == nil {
+			delete(props, k)
+		} else {
+			props[k] = v
+		}
+	}
+	if r.URL != "" {
+		props["url"] = r.URL
+	}
+	return props
+}
+
+// expandEnv returns the properties with the `${VAR}` references
+// expanded, as when the env file is loaded. Only the properties read
+// from the env file are expanded.
+func expandEnv(props map[string]any) map[string]any {
+	envMap := g.M()
+	for _, tuple := range os.Environ() {
+		key, val, _ := strings.Cut(tuple, "=")
+		envMap[key] = val
+	}
+
+	expanded := map[string]any{}
+	for k, v := range props {
+		if s, ok := v.(string); ok {
+			v = g.Rmd(s, envMap)
+		}
+		expanded[k] = v
+	}
+	return expanded
+}
+
+// ValidateConnection returns the connection of the properties, with the
+// secrets decrypted. The type is
+// required, unless deduced from the URL. Only database and file
+// connections are supported.
+func ValidateConnection(name string, props map[string]any) (conn connection.Connection, err error) {
+	if !connNameRegex.MatchString(name) {
+		return conn, g.Error("invalid connection name %s, use letters, digits and underscores", name)
+	} else if len(props) == 0 {
+		return conn, g.Error("no url or properties specified for connection %s", name)
+	}
+
+	if conn, err = loadConnection(name, props); err != nil {
+		return conn, err
+	} else if hasTunnel(conn.Data) {
+		if _, err = NewTunnelConfig(conn); err != nil {
+			return conn, err
+		}
+	}
+	return conn, nil
+}
+
+// loadConnection returns the connection of the properties, with the
+// secrets decrypted
+func loadConnection(name string, props map[string]any) (conn connection.Connection, err error) {
+	data, err := env.DecryptProps(props)
+	if err != nil {
+		return conn, g.Error(err, "could not decrypt connection %s", name)
+	}
+
+	connType := dbio.Type(cast.ToString(data["type"]))
+	if connType != "" {
+		if _, ok := dbio.ValidateType(connType.String()); !ok {
+			return conn, g.Error("invalid connection type %s", connType)
+		}
+	} else if url := cast.ToString(data["url"]); url == "" {
+		return conn, g.Error("the type or url of connection %s is required", name)
+	} else if connType = connection.SchemeType(url); connType.IsUnknown() {
+		return conn, g.Error("could not determine the type of connection %s from its url", name)
+	}
+
+	conn, err = connection.NewConnectionFromMap(g.M("name", name, "data", data, "type", connType.String()))
+	if err != nil {
+		return conn, g.Error(err, "invalid connection %s", name)
+	} else if !conn.Type.IsDb() && !conn.Type.IsFile() {
+		return conn, g.Error("connection type %s is not supported", conn.Type)
+	}
+	return conn, nil
+}
+
+// TestConnection connects with the connection, through its SSH tunnel
+func TestConnection(conn connection.Connection) (err error) {
+	if conn, err = tunnelConnection(conn); err != nil {
+		return g.Error(err, "could not open tunnel of connection %s", conn.Name)
+	} else if !conn.Type.IsDb() {
+		defer conn.Close()
+		if _, err = conn.Test(); err != nil {
+			return g.Error(err, "could not connect with %s", conn.Name)
+		}
+		return nil
+	}
+
+	dbConn, err := conn.AsDatabase(false) // not cached
+	if err != nil {
+		return g.Error(err, "could not initiate %s", conn.Name)
+	}
+	defer closeTestConnection(dbConn)
+
+	if err = dbConn.Connect(10); err != nil {
+		return g.Error(err, "could not connect with %s", conn.Name)
+	}
+	return nil
+}
+
+// closeTestConnection closes the tested database. With USE_POOL (set
+// by dbREST), databases are pooled by URL and shared: a database taken
+// from the pool (e.g. the one of a loaded connection) is left open, and
+// one added to the pool by the test only closes its sessions, to stay
+// usable by the connection once saved.
+func closeTestConnection(conn database.Connection) {
+	pooled := os.Getenv("USE_POOL") == "TRUE" && cast.ToBool(conn.GetProp("connected"))
+	if cast.ToBool(conn.GetProp("POOL_USED")) {
+		return
+	} else if db := conn.Db(); pooled && db != nil {
+		db.SetMaxIdleConns(0) // closes the idle sessions
+		db.SetMaxIdleConns(2) // default of database/sql
+	} else if !pooled {
+		g.LogError(conn.Close(), "could not close connection")
+	}
+}
+
+// FindConnection returns the local connection with the name, and
+// whether it is defined in the dbNet env file (editable)
+func FindConnection(name string) (entry connection.ConnEntry, editable bool, err error) {
+	entry = localConns(true).Get(name)
+	props, err := env.GetConnection(name)
+	return entry, props != nil, err
+}
+
+// AddConnection validates and tests the new connection,
+// and writes it to the dbNet env file
+func AddConnection(req ConnRequest) (conn connection.Connection, err error) {
+	entry, _, err := FindConnection(req.Name)
+	if err != nil {
+		return conn, err
+	} else if entry.Name != "" {
+		return conn, g.Error("connection %s already exists (%s)", entry.Name, entry.Source)
+	}
+
+	return saveConnection(req, nil)
+}
+
+// EditConnection merges the request into the connection of the dbNet
+// env file, and writes it back once validated and tested
+func EditConnection(req ConnRequest) (conn connection.Connection, err error) {
+	current, err := env.GetConnection(req.Name)
+	if err != nil {
+		return conn, err
+	} else if current == nil {
+		return conn, connNotEditableError(req.Name)
+	}
+
+	return saveConnection(req, current)
+}
+
+// RemoveConnection removes the connection from the dbNet env file
+func RemoveConnection(name string) (err error) {
+	found, err := env.RemoveConnection(name)
+	if err != nil {
+		return g.Error(err, "could not remove connection %s", name)
+	} else if !found {
+		return connNotEditableError(name)
+	}
+
+	reloadConnections()
+	return nil
+}
+
+// saveConnection merges the request into the current properties, and
+// writes them once validated and tested
+func saveConnection(req ConnRequest, current map[string]any) (conn connection.Connection, err error) {
+	props := req.merge(current)
+	if conn, err = ValidateConnection(req.Name, req.merge(expandEnv(current))); err != nil {
+		return conn, err
+	} else if !req.SkipTest {
+		if err = TestConnection(conn); err != nil {
+			return conn, err
+		}
+	}
+
+	if env.HasSecretKey() {
+		if props, err = env.EncryptProps(props); err != nil {
+			return conn, g.Error(err, "could not encrypt connection %s", req.Name)
+		}
+	}
+
+	if err = env.SetConnection(req.Name, props); err != nil {
+		return conn, g.Error(err, "could not save connection %s", req.Name)
+	}
+
+	reloadConnections()
+	return conn, nil
+}
+
+// EncryptConnections encrypts the plain secrets of the connections
+// of the dbNet env file, and returns the names of the changed ones
+func EncryptConnections() (names []string, err error) {
+	if !env.HasSecretKey() {
+		return nil, g.Error("no secret key defined. Please set DBNET_SECRET_PASSPHRASE or DBNET_SECRET_KEYFILE")
+	}
+
+	allNames, err := env.ListConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range allNames {
+		props, err := env.GetConnection(name)
+		if err != nil {
+			return names, err
+		}
+
+		plain := false
+		for k, v := range props {
+			plain = plain || env.IsSecretProp(k, v)
+		}
+		if !plain {
+			continue
+		}
+
+		if props, err = env.EncryptProps(props); err != nil {
+			return names, g.Error(err, "could not encrypt connection %s", name)
+		} else if err = env.SetConnection(name, props); err != nil {
+			return names, g.Error(err, "could not save connection %s", name)
+		}
+		names = append(names, strings.ToUpper(name))
+	}
+
+	if len(names) > 0 {
+		reloadConnections()
+	}
+	return names, nil
+}
+
+// LocalConnection returns the local connection with the name. The
+// secrets of the connections of the dbNet env file are decrypted.
+func LocalConnection(name string) (conn connection.Connection, err error) {
+	props, err := env.GetConnection(name)
+	if err != nil {
+		return conn, err
+	} else if props != nil {
+		return loadConnection(name, expandEnv(props))
+	}
+
+	entry := localConns().Get(name)
+	if entry.Name == "" {
+		return conn, g.Error("connection %s does not exist", name)
+	}
+	return entry.Connection, nil
+}
+
+// preparedConns are the connections with their secrets decrypted and
+// through their SSH tunnel, by connection name. preparedEnv are the
+// environment variables set by prepareConnection, with the values they
+// replaced (nil if unset), and preparedEntries the entries they hide.
+var (
+	preparedConns    = map[string]connection.Connection{}
+	preparedEnv      = map[string]*string{}
+	preparedEntries  = map[string]connection.ConnEntry{}
+	preparedConnsMux sync.Mutex
+)
+
+// GetConnInstance returns a connected instance of the connection, with
+// its secrets decrypted and through its SSH tunnel
+func GetConnInstance(name, databaseName string) (conn database.Connection, err error) {
+	prepared, err := preparedConnection(name)
+	if err != nil {
+		return nil, err
+	} else if prepared.Name == "" {
+		return dbRestState.DefaultProject().GetConnInstance(name, databaseName)
+	}
+
+	// as dbREST does, with a specific database
+	connObj := prepared
+	if databaseName != "" {
+		data := g.M()
+		for k, v := range prepared.Data {
+			data[k] = v
+		}
+		data["database"] = strings.ToLower(databaseName)
+		delete(data, "url")
+		delete(data, "schema")
+		connObj, err = connection.NewConnectionFromMap(g.M("name", prepared.Name, "data", data, "type", prepared.Type))
+		if err != nil {
+			return nil, g.Error(err, "could not load connection %s", name)
+		}
+	}
+
+	os.Setenv("USE_POOL", "TRUE") // shared with the instances of dbREST
+	conn, err = database.NewConn(connObj.URL(), g.MapToKVArr(connObj.DataS())...)
+	if err != nil {
+		return nil, g.Error(err, "could not initialize connection %s", name)
+	} else if err = conn.Connect(); err != nil {
+		return nil, g.Error(err, "could not connect with %s", name)
+	}
+	return conn, nil
+}
+
+// preparedConnection returns the connection with its secrets decrypted,
+// in memory only, and through its SSH tunnel, which is opened if needed.
+// The connection is empty if it needs no preparing.
+func preparedConnection(name string) (conn connection.Connection, err error) {
+	var source connection.Connection
+	if props, err := env.GetConnection(name); err != nil {
+		return conn, err
+	} else if props != nil && (env.HasEncrypted(props) || hasTunnel(props)) {
+		if source, err = loadConnection(name, expandEnv(props)); err != nil {
+			return conn, g.Error(err, "could not load connection %s", name)
+		}
+	} else if entry := localConns().Get(name); props == nil && hasTunnel(entry.Connection.Data) {
+		source = entry.Connection
+	} else {
+		return conn, nil
+	}
+
+	if conn, err = tunnelConnection(source); err != nil {
+		return conn, g.Error(err, "could not open tunnel of connection %s", name)
+	}
+
+	key := strings.ToLower(name)
+	preparedConnsMux.Lock()
+	defer preparedConnsMux.Unlock()
+	if cached, ok := preparedConns[key]; ok && g.Marshal(cached.Data) == g.Marshal(conn.Data) {
+		return cached, nil // unchanged
+	}
+	preparedConns[key] = conn
+	return conn, nil
+}
+
+// prepareConnection has dbREST use the prepared connection, for the
+// queries and the routes it runs. dbREST loads its connections (under
+// its own locks) from the env files, with the secrets encrypted, and
+// from the environment variables, which override them: the prepared
+// connection is set as an environment variable of the process, as the
+// secret passphrase is, and the connections reloaded when it changes.
+func prepareConnection(name string) (err error) {
+	prepared, err := preparedConnection(name)
+	if err != nil || prepared.Name == "" {
+		return err
+	}
+
+	payload := g.M()
+	for k, v := range prepared.Data {
+		payload[k] = v
+	}
+	payload["type"] = prepared.Type
+	envKey, value := strings.ToUpper(name), g.Marshal(payload)
+
+	preparedConnsMux.Lock()
+	if os.Getenv(envKey) == value {
+		preparedConnsMux.Unlock()
+		return nil
+	} else if _, ok := preparedEnv[envKey]; !ok {
+		preparedEntries[strings.ToLower(name)] = connection.GetLocalConns(true).Get(name)
+		if prev, ok := os.LookupEnv(envKey); ok {
+			preparedEnv[envKey] = &prev
+		} else {
+			preparedEnv[envKey] = nil
+		}
+	}
+	os.Setenv(envKey, value)
+	preparedConnsMux.Unlock()
+
+	if err = dbRestState.DefaultProject().LoadConnections(true); err != nil {
+		return g.Error(err, "could not reload connections")
+	}
+	return nil
+}
+
+// localConns returns the local connections, with the entries of the
+// prepared connections as they are defined (not as handed to dbREST)
+func localConns(force ...bool) (entries connection.ConnEntries) {
+	entries = connection.GetLocalConns(force...)
+	preparedConnsMux.Lock()
+	defer preparedConnsMux.Unlock()
+	if len(preparedEntries) == 0 {
+		return entries
+	}
+
+	conns := make(connection.ConnEntries, len(entries))
+	for i, entry := range entries {
+		if prepared, ok := preparedEntries[strings.ToLower(entry.Name)]; ok {
+			entry = prepared
+		}
+		conns[i] = entry
+	}
+	return conns
+}
+
+// connNotEditableError returns the error of a connection
+// which is not in the dbNet env file
+func connNotEditableError(name string) error {
+	if entry := localConns().Get(name); entry.Name != "" {
+		return g.Error("connection %s is not in %s (source: %s), it cannot be changed", entry.Name, env.HomeDirEnvFile, entry.Source)
+	}
+	return g.Error("connection %s does not exist", name)
+}
+
+// reloadConnections refreshes the connections of the server
+func reloadConnections() {
+	preparedConnsMux.Lock()
+	for envKey, prev := range preparedEnv {
+		if prev == nil {
+			os.Unsetenv(envKey)
+		} else {
+			os.Setenv(envKey, *prev)
+		}
+	}
+	preparedConns = map[string]connection.Connection{}
+	preparedEnv = map[string]*string{}
+	preparedEntries = map[string]connection.ConnEntry{}
+	preparedConnsMux.Unlock()
+
+	g.LogError(dbRestState.DefaultProject().LoadConnections(true), "could not reload connections")
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/labstack/echo/v5/middleware"
+)
+
+// CORSConfig is the cross-origin configuration, from the environment
+// variables or the `variables` section of the env file. Same-origin
+// requests are always allowed.
+type CORSConfig struct {
+	Origins     []string // DBNET_CORS_ORIGINS, comma separated, with `*` wildcards (default: the desktop app origins)
+	Headers     []string // DBNET_CORS_HEADERS, allowed in addition to the dbNet headers
+	Credentials bool     // DBNET_CORS_CREDENTIALS, allows cookies on cross-origin requests, not with `*`
+	Hosts       []string // DBNET_ALLOWED_HOSTS, host names accepted in addition to localhost, the machine and bind host names, and DBNET_TLS_HOSTS
+}
+
+// CORS is the cross-origin configuration of the server
+var CORS = CORSConfig{}
+
+// defaultCORSOrigins are the origins of the desktop (Tauri) app
+var defaultCORSOrigins = []string{"tauri://localhost", "http://tauri.localhost", "https://tauri.localhost"}
+
+// corsHeaders are the request headers used by the app
+var corsHeaders = []string{
+	echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization, echo.HeaderAccept,
+	"X-Request-ID", "X-Request-Columns", "X-Request-Continue", "X-Request-Params",
+	"access-control-allow-origin", "access-control-allow-headers",
+}
+
+// LoadCORSConfig loads the cross-origin configuration
+func LoadCORSConfig() (cc CORSConfig) {
+	cc.Origins = splitList(env.GetVar("DBNET_CORS_ORIGINS"))
+	if len(cc.Origins) == 0 {
+		cc.Origins = defaultCORSOrigins
+	}
+	cc.Headers = append(append([]string{}, corsHeaders...), splitList(env.GetVar("DBNET_CORS_HEADERS"))...)
+	cc.Credentials = g.In(strings.ToLower(env.GetVar("DBNET_CORS_CREDENTIALS")), "true", "1", "yes")
+	if cc.Credentials && g.In("*", cc.Origins...) {
+		g.Warn("DBNET_CORS_CREDENTIALS cannot be used with the `*` origin, credentials are not allowed")
+		cc.Credentials = false
+	}
+
+	cc.Hosts = append(selfSignedHosts(os.Getenv("HOST"), splitList(env.GetVar("DBNET_TLS_HOSTS"))), splitList(env.GetVar("DBNET_ALLOWED_HOSTS"))...)
+	return
+}
+
+// HostAllowed returns true if the requests to the host are accepted: an
+// IP address or a known host name. Other names could resolve to the
+// server with DNS rebinding, making a foreign page same-origin.
+func (cc CORSConfig) HostAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, allowed := range cc.Hosts {
+		if strings.EqualFold(strings.TrimSuffix(host, "."), allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if the cross-origin requests of the origin are allowed
+func (cc CORSConfig) Allowed(origin string) bool {
+	for _, pattern := range cc.Origins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		} else if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns the CORS middleware of the configuration
+func (cc CORSConfig) Middleware() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowHeaders:     cc.Headers,
+		AllowCredentials: cc.Credentials,
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return cc.Allowed(origin), nil
+		},
+	})
+}
+
+// originMiddleware rejects the requests to unknown host names (DNS
+// rebinding), and from other origins which are not allowed. Browsers
+// send simple requests (e.g. form posts) without a preflight, so
+// omitting the CORS headers is not enough.
+func originMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		if !CORS.HostAllowed(c.Request().Host) {
+			return g.ErrJSON(http.StatusForbidden, g.Error("host %s is not allowed, add it to DBNET_ALLOWED_HOSTS", c.Request().Host))
+		}
+
+		origin := c.Request().Header.Get(echo.HeaderOrigin)
+		if origin == "" || isSameOrigin(c, origin) || CORS.Allowed(origin) {
+			return next(c)
+		}
+		return g.ErrJSON(http.StatusForbidden, g.Error("origin %s is not allowed", origin))
+	}
+}
+
+// isSameOrigin returns true if the origin is the scheme and host of
+// the request, once validated by HostAllowed
+func isSameOrigin(c echo.Context, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Scheme, c.Scheme()) && strings.EqualFold(u.Host, c.Request().Host)
+}
+
+// splitList splits a comma separated value
+func splitList(val string) (items []string) {
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
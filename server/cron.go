@@ -0,0 +1,191 @@
+package server
+
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flarco/g"
+)
+
+// Cron is a parsed cron expression, with the standard 5 fields:
+// minute, hour, day of month, month and day of week.
+// Each field is a bitmask of the allowed values.
+type Cron struct {
+	Expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// when both day fields are restricted, either can match
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a 5-field cron expression or a descriptor
+// such as `@daily`. Fields accept `*`, values, ranges (`1-5`),
+// steps (`*/15`, `0-30/5`), lists (`1,15`) and month/day names.
+func ParseCron(expr string) (c *Cron, err error) {
+	c = &Cron{Expr: strings.TrimSpace(expr)}
+
+	spec := strings.ToLower(c.Expr)
+	if val, ok := cronDescriptors[spec]; ok {
+		spec = val
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, g.Error("invalid cron expression '%s': expected 5 fields, got %d", expr, len(parts))
+	}
+
+	masks := make([]uint64, len(parts))
+	for i, part := range parts {
+		masks[i], err = cronFields[i].parse(part)
+		if err != nil {
+			return nil, g.Error(err, "invalid cron expression '%s'", expr)
+		}
+	}
+
+	c.minute, c.hour, c.dom, c.month, c.dow = masks[0], masks[1], masks[2], masks[3], masks[4]
+	c.domStar = strings.HasPrefix(parts[2], "*")
+	c.dowStar = strings.HasPrefix(parts[4], "*")
+
+	// 7 is also sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow = (c.dow | 1) &^ (1 << 7)
+	}
+
+	return c, nil
+}
+
+// parse returns the bitmask of a field
+func (cf cronField) parse(part string) (mask uint64, err error) {
+	for _, item := range strings.Split(part, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, g.Error("invalid step '%s' in %s field", stepStr, cf.name)
+			}
+		}
+
+		start, end := cf.min, cf.max
+		switch {
+		case rangeStr == "*":
+		case strings.Contains(rangeStr, "-"):
+			startStr, endStr, _ := strings.Cut(rangeStr, "-")
+			if start, err = cf.value(startStr); err != nil {
+				return 0, err
+			}
+			if end, err = cf.value(endStr); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, g.Error("invalid range '%s' in %s field", rangeStr, cf.name)
+			}
+		default:
+			if start, err = cf.value(rangeStr); err != nil {
+				return 0, err
+			}
+			if !hasStep {
+				end = start // `5/10` means from 5 to max
+			}
+		}
+
+		for i := start; i <= end; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+func (cf cronField) value(s string) (val int, err error) {
+	if v, ok := cf.names[s]; ok {
+		return v, nil
+	}
+	val, err = strconv.Atoi(s)
+	if err != nil || val < cf.min || val > cf.max {
+		return 0, g.Error("invalid value '%s' in %s field (%d-%d)", s, cf.name, cf.min, cf.max)
+	}
+	return val, nil
+}
+
+// matchDay returns true if the day matches the day of month
+// and day of week fields
+func (c *Cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the next time matching the schedule, strictly after t.
+// Returns the zero time if there is none within 5 years (e.g. `0 0 30 2 *`).
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			// jump to the next allowed minute of the hour, if any
+			if next := c.minute >> uint(t.Minute()); next != 0 {
+				t = t.Add(time.Duration(bits.TrailingZeros64(next)) * time.Minute)
+			} else {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			}
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,512 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/dbnet-io/dbnet/store"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+)
+
+// DetachedQueryInfo is the state of a detached query
+type DetachedQueryInfo struct {
+	ID        string                  `json:"id"`
+	Conn      string                  `json:"conn"`
+	Database  string                  `json:"database"`
+	Text      string                  `json:"text"`
+	Limit     int                     `json:"limit"`
+	Status    dbRestState.QueryStatus `json:"status"`
+	Err       string                  `json:"err"`
+	Start     int64                   `json:"start"`
+	End       int64                   `json:"end"`
+	Affected  int64                   `json:"affected"`
+	Columns   [][]string              `json:"columns"`   // name, type, db type
+	Rows      int64                   `json:"rows"`      // rows spilled so far
+	Bytes     int64                   `json:"bytes"`     // bytes spilled so far
+	Truncated bool                    `json:"truncated"` // spill size limit reached
+	User      string                  `json:"user"`
+	ClientIP  string                  `json:"client_ip"`
+}
+
+// DetachedQuery is a query owned by the server, not by the HTTP request.
+// The results are streamed to a spill file, so that any client can
+// reattach with the query ID to get the status and results.
+type DetachedQuery struct {
+	DetachedQueryInfo
+	query   *dbRestState.Query
+	done    chan struct{} // closed when finished
+	release func()        // releases the slot of the connection
+	mux     sync.Mutex
+}
+
+var (
+	detachedQueries = map[string]*DetachedQuery{} // running queries
+	detachedMux     sync.Mutex
+)
+
+// spillFlushRows is the number of rows between flushes of the spill file
+const spillFlushRows = 1000
+
+// spillMaxBytes is the size limit of a spill file, from
+// DBNET_SPILL_MAX_MB (1024 by default, 0 for no limit)
+func spillMaxBytes() int64 {
+	if val := env.GetVar("DBNET_SPILL_MAX_MB"); val != "" {
+		return int64(cast.ToFloat64(val) * 1024 * 1024)
+	}
+	return 1024 * 1024 * 1024
+}
+
+// SpillPath returns the path of the results spill file
+func (dq *DetachedQuery) SpillPath() string {
+	return path.Join(env.SpillDir(), dq.ID+".jsonl")
+}
+
+// metaPath returns the path of the state file, used to
+// reattach after a server restart
+func (dq *DetachedQuery) metaPath() string {
+	return path.Join(env.SpillDir(), dq.ID+".json")
+}
+
+// Info returns a copy of the current state
+func (dq *DetachedQuery) Info() DetachedQueryInfo {
+	dq.mux.Lock()
+	defer dq.mux.Unlock()
+	return dq.DetachedQueryInfo
+}
+
+// IsRunning returns true if the query is executing or spilling
+func (dq *DetachedQuery) IsRunning() bool {
+	dq.mux.Lock()
+	defer dq.mux.Unlock()
+	return dq.Status == dbRestState.QueryStatusSubmitted
+}
+
+// SubmitDetachedQuery submits the query in the background, once it
+// has a slot of the connection. It waits in the queue of the connection
+// until the context is done (the request is closed).
+func SubmitDetachedQuery(ctx context.Context, dq *DetachedQuery) (err error) {
+	if dq.ID == "" {
+		dq.ID = g.NewTsID("sql")
+	} else if strings.ContainsAny(dq.ID, `/\`) {
+		return g.Error("invalid query id: %s", dq.ID)
+	}
+	dq.Conn = strings.ToLower(dq.Conn)
+	dq.Database = strings.ToLower(dq.Database)
+
+	if _, err = GetDetachedQuery(dq.ID); err == nil {
+		return g.Error("query %s already exists", dq.ID)
+	}
+
+	if err = os.MkdirAll(env.SpillDir(), 0755); err != nil {
+		return g.Error(err, "could not create spill folder")
+	}
+
+	query := dbRestState.DefaultProject().NewQuery(context.Background())
+	query.ID = dq.ID
+	query.Conn = dq.Conn
+	query.Database = dq.Database
+	query.Text = dq.Text
+	query.Limit = dq.Limit
+	query.Start = time.Now().Unix()
+
+	dq.query = query
+	dq.done = make(chan struct{})
+	dq.Status = dbRestState.QueryStatusSubmitted
+	dq.Start = query.Start
+	dq.Affected = -1
+
+	if dq.release, err = acquireSlot(ctx, dq.Conn, dq.Database, dq.ID, dq.User); err != nil {
+		return err
+	} else if err = prepareConnection(dq.Conn); err != nil {
+		dq.release()
+		return g.Error(err, "could not prepare connection")
+	}
+
+	query, err = dbRestState.SubmitOrGetQuery(query, false)
+	if err != nil {
+		dq.release()
+		return g.Error(err, "could not submit query")
+	}
+
+	detachedMux.Lock()
+	detachedQueries[dq.ID] = dq
+	detachedMux.Unlock()
+
+	dq.saveMeta()
+	g.LogError(processQuery(nil, dq.historyQuery()), "could not save query")
+
+	go dq.run()
+
+	return
+}
+
+// run waits for the query and spills the results
+func (dq *DetachedQuery) run() {
+	defer func() {
+		detachedMux.Lock()
+		delete(detachedQueries, dq.ID)
+		detachedMux.Unlock()
+		close(dq.done)
+	}()
+
+	<-dq.query.Done
+	err := dq.query.ProcessResult()
+	if err == nil && dq.query.Affected == -1 && dq.query.Stream != nil {
+		err = dq.spill()
+	}
+	dq.release()
+
+	dq.mux.Lock()
+	dq.End = time.Now().Unix()
+	dq.Affected = dq.query.Affected
+	switch {
+	case dq.Status != dbRestState.QueryStatusSubmitted:
+		// cancelled or interrupted
+	case err != nil:
+		dq.Status = dbRestState.QueryStatusErrored
+		dq.Err = g.ErrMsgSimple(err)
+	default:
+		dq.Status = dbRestState.QueryStatusCompleted
+	}
+	dq.mux.Unlock()
+
+	dq.saveMeta()
+	g.LogError(processQuery(nil, dq.historyQuery()), "could not save query")
+	g.LogError(dq.saveResult(), "could not save query result")
+	recordAudit(dq.auditEvent())
+}
+
+// auditEvent returns the audit event of the finished query
+func (dq *DetachedQuery) auditEvent() *store.AuditEvent {
+	info := dq.Info()
+	return &store.AuditEvent{
+		Time:         info.Start,
+		User:         info.User,
+		ClientIP:     info.ClientIP,
+		Action:       AuditSQL,
+		Conn:         info.Conn,
+		Database:     info.Database,
+		QueryID:      info.ID,
+		Text:         info.Text,
+		Status:       string(info.Status),
+		Err:          info.Err,
+		RowsAffected: info.Affected,
+		Duration:     float64(info.End - info.Start),
+	}
+}
+
+// saveResult saves the first rows of a completed query, within the results budget
+func (dq *DetachedQuery) saveResult() (err error) {
+	info := dq.Info()
+	budget := Results
+	if !budget.IsEnabled() || info.Status != dbRestState.QueryStatusCompleted || len(info.Columns) == 0 {
+		return nil
+	}
+
+	// one more row to know if truncated
+	buf := bytes.NewBuffer(nil)
+	if _, err = dq.ReadResults(buf, 0, int64(budget.MaxRows)+1); err != nil {
+		return g.Error(err, "could not read spilled results")
+	}
+
+	headers := make([]string, len(info.Columns))
+	for i, col := range info.Columns {
+		headers[i] = col[0]
+	}
+
+	result, err := budget.ParseResult("application/jsonlines", headers, buf.Bytes(), false)
+	if err != nil {
+		return g.Error(err, "could not parse spilled results")
+	}
+
+	result.QueryID = dq.ID
+	return store.SaveQueryResult(&result)
+}
+
+// spill writes the result rows as JSON lines, the first line being
+// the column names (same as the dbREST streaming format)
+func (dq *DetachedQuery) spill() (err error) {
+	ds := dq.query.Stream
+
+	file, err := os.Create(dq.SpillPath())
+	if err != nil {
+		return g.Error(err, "could not create spill file")
+	}
+	defer file.Close()
+
+	columns := make([][]string, len(ds.Columns))
+	for i, col := range ds.Columns {
+		columns[i] = []string{col.Name, string(col.Type), col.DbType}
+	}
+
+	counter := &countingWriter{w: file}
+	bufW := bufio.NewWriter(counter)
+	enc := json.NewEncoder(bufW)
+
+	flush := func(rows int64) (err error) {
+		if err = bufW.Flush(); err != nil {
+			return g.Error(err, "could not write spill file")
+		}
+		dq.mux.Lock()
+		dq.Rows, dq.Bytes = rows, counter.n
+		dq.mux.Unlock()
+		return
+	}
+
+	if err = enc.Encode(ds.Columns.Names()); err != nil {
+		return g.Error(err, "could not write spill file")
+	}
+
+	dq.mux.Lock()
+	dq.Columns = columns
+	dq.mux.Unlock()
+	if err = flush(0); err != nil {
+		return
+	}
+
+	var rows int64
+	maxBytes := spillMaxBytes()
+	lastFlush := time.Now()
+	for row := range ds.Rows() {
+		if maxBytes > 0 && counter.n+int64(bufW.Buffered()) >= maxBytes {
+			// stop the query, keep the rows spilled so far
+			ds.Context.Cancel()
+			dq.mux.Lock()
+			dq.Truncated = true
+			dq.mux.Unlock()
+			g.Debug("query %s reached the spill size limit of %d bytes", dq.ID, maxBytes)
+			return flush(rows)
+		}
+
+		if err = enc.Encode(row); err != nil {
+			ds.Context.Cancel()
+			return g.Error(err, "could not encode row")
+		}
+		rows++
+
+		if rows%spillFlushRows == 0 || time.Since(lastFlush) > time.Second {
+			if err = flush(rows); err != nil {
+				ds.Context.Cancel()
+				return
+			}
+			lastFlush = time.Now()
+		}
+	}
+
+	if err = ds.Err(); err != nil {
+		return g.Error(err, "could not stream results")
+	}
+
+	return flush(rows)
+}
+
+// Cancel cancels the running query
+func (dq *DetachedQuery) Cancel() (err error) {
+	if !dq.IsRunning() {
+		return g.Error("query %s is not running", dq.ID)
+	}
+
+	dq.mux.Lock()
+	dq.Status = dbRestState.QueryStatusCancelled
+	dq.mux.Unlock()
+
+	if dq.query.Context != nil {
+		dq.query.Context.Cancel()
+	}
+	if ds := dq.query.Stream; ds != nil {
+		ds.Context.Cancel()
+	}
+	return
+}
+
+// Wait waits for the query to finish, up to the timeout.
+// Returns false if timed out.
+func (dq *DetachedQuery) Wait(timeout time.Duration) bool {
+	if dq.done == nil {
+		return true // from state file
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-dq.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Remove deletes the spill and state files
+func (dq *DetachedQuery) Remove() (err error) {
+	for _, filePath := range []string{dq.SpillPath(), dq.metaPath()} {
+		if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return g.Error(err, "could not remove %s", filePath)
+		}
+	}
+	return nil
+}
+
+// ReadResults streams the spilled rows to the writer as JSON lines,
+// starting with the column names. A limit of 0 means all rows.
+// Only the rows spilled so far are read if the query is still running.
+func (dq *DetachedQuery) ReadResults(w io.Writer, offset, limit int64) (count int64, err error) {
+	info := dq.Info()
+
+	file, err := os.Open(dq.SpillPath())
+	if os.IsNotExist(err) {
+		return 0, g.Error("query %s has no results", dq.ID)
+	} else if err != nil {
+		return 0, g.Error(err, "could not open spill file")
+	}
+	defer file.Close()
+
+	// only read complete lines
+	reader := bufio.NewReader(io.LimitReader(file, info.Bytes))
+
+	for i := int64(-1); ; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, g.Error(err, "could not read spill file")
+		}
+
+		if i >= 0 && i < offset {
+			continue // header line is i = -1
+		} else if limit > 0 && count >= limit {
+			return count, nil
+		} else if i >= 0 {
+			count++
+		}
+
+		if _, err = w.Write(line); err != nil {
+			return count, g.Error(err, "could not write results")
+		}
+	}
+}
+
+// saveMeta writes the state file
+func (dq *DetachedQuery) saveMeta() {
+	info := dq.Info()
+	err := os.WriteFile(dq.metaPath(), []byte(g.Marshal(info)), 0644)
+	g.LogError(err, "could not save state of query %s", dq.ID)
+}
+
+// historyQuery returns the query to record in the history
+func (dq *DetachedQuery) historyQuery() *dbRestState.Query {
+	info := dq.Info()
+	headers := make(dbRestState.Headers, len(info.Columns))
+	for i, col := range info.Columns {
+		headers[i] = col[0]
+	}
+
+	return &dbRestState.Query{
+		ID:       info.ID,
+		Project:  dq.query.Project,
+		Conn:     info.Conn,
+		Database: info.Database,
+		Text:     info.Text,
+		Start:    info.Start,
+		End:      info.End,
+		Status:   info.Status,
+		Err:      info.Err,
+		Headers:  headers,
+	}
+}
+
+// GetDetachedQuery returns a running query, or the state of
+// a previous one from its state file
+func GetDetachedQuery(id string) (dq *DetachedQuery, err error) {
+	detachedMux.Lock()
+	dq, ok := detachedQueries[id]
+	detachedMux.Unlock()
+	if ok {
+		return dq, nil
+	}
+
+	if strings.ContainsAny(id, `/\`) {
+		return nil, g.Error("invalid query id: %s", id)
+	}
+
+	dq = &DetachedQuery{DetachedQueryInfo: DetachedQueryInfo{ID: id}}
+	b, err := os.ReadFile(dq.metaPath())
+	if os.IsNotExist(err) {
+		return nil, g.Error("detached query %s not found", id)
+	} else if err != nil {
+		return nil, g.Error(err, "could not read state of query %s", id)
+	}
+
+	if err = json.Unmarshal(b, &dq.DetachedQueryInfo); err != nil {
+		return nil, g.Error(err, "could not parse state of query %s", id)
+	}
+
+	if dq.Status == dbRestState.QueryStatusSubmitted {
+		// the server stopped while running
+		dq.Status = dbRestState.QueryStatusErrored
+		dq.Err = "query was interrupted by a server restart"
+	}
+
+	return dq, nil
+}
+
+// CloseDetachedQueries interrupts the running queries, keeping the
+// results spilled so far
+func CloseDetachedQueries() {
+	detachedMux.Lock()
+	queries := lo.Values(detachedQueries)
+	detachedMux.Unlock()
+
+	for _, dq := range queries {
+		if !dq.IsRunning() {
+			continue
+		}
+
+		dq.mux.Lock()
+		dq.Status = dbRestState.QueryStatusErrored
+		dq.Err = "query was interrupted by a server shutdown"
+		dq.End = time.Now().Unix()
+		dq.mux.Unlock()
+
+		if dq.query.Context != nil {
+			dq.query.Context.Cancel()
+		}
+		dq.saveMeta()
+		g.LogError(processQuery(nil, dq.historyQuery()), "could not save query")
+	}
+}
+
+// ListDetachedQueries returns the running queries
+func ListDetachedQueries() (queries []DetachedQueryInfo) {
+	detachedMux.Lock()
+	defer detachedMux.Unlock()
+
+	queries = []DetachedQueryInfo{}
+	for _, dq := range detachedQueries {
+		queries = append(queries, dq.Info())
+	}
+	return
+}
+
+// countingWriter counts the bytes written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dbnet-io/dbnet/env"
 	"github.com/flarco/g"
 )
 
@@ -15,6 +22,10 @@ const (
 	OperationRead   Operation = "read"
 	OperationWrite  Operation = "write"
 	OperationDelete Operation = "delete"
+	OperationRename Operation = "rename"
+	OperationMove   Operation = "move"
+	OperationCopy   Operation = "copy"
+	OperationMkdir  Operation = "mkdir"
 )
 
 // FileItem represents a file
@@ -23,14 +34,241 @@ type FileItem struct {
 	Path  string `json:"path" query:"path"`
 	IsDir bool   `json:"isDir" query:"isDir"`
 	ModTs int64  `json:"modTs" query:"modTs"`
+	Hash  string `json:"hash" query:"hash"`         // SHA-256 of the contents
+	Git   string `json:"git,omitempty" query:"git"` // git status code when listed in a repository (e.g. ` M`, `??`)
 	Body  string `json:"body" query:"body"`
 }
 
+// FileConflictError is returned when writing a file which was
+// modified since it was read. Current is the file on disk.
+type FileConflictError struct {
+	Path    string
+	Exists  bool
+	Current FileItem
+}
+
+func (e *FileConflictError) Error() string {
+	if !e.Exists {
+		return g.F("file %s was deleted by another process", e.Path)
+	}
+	return g.F("file %s was modified by another process", e.Path)
+}
+
+// listHashMaxBytes is the size above which the listed files are not hashed
+const listHashMaxBytes = 10 * 1024 * 1024
+
+// fileWriteMux makes the conflict check and write atomic
+var fileWriteMux sync.Mutex
+
+// hashContent returns the SHA-256 hex digest of the contents
+func hashContent(content []byte) string {
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
+
+// hashFile returns the SHA-256 hex digest of the file
+func hashFile(path string) (hash string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", g.Error(err, "unable to open file: %s", path)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", g.Error(err, "unable to read file: %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // FileRequest is the typical request struct for file operations
 type FileRequest struct {
 	Operation Operation `json:"operation" query:"operation"`
 	File      FileItem  `json:"file" query:"file"`
 	Overwrite bool      `json:"overwrite" query:"overwrite"`
+	Target    string    `json:"target" query:"target"`       // new name (rename) or destination path (move, copy)
+	Recursive bool      `json:"recursive" query:"recursive"` // list sub-folders, or delete non-empty folders
+	Globs     []string  `json:"globs" query:"globs"`         // list the files matching any of the patterns
+	Git       bool      `json:"git" query:"git"`             // list with the git status of the files
+}
+
+// defaultRoot is the default workspace root, created on first use
+var defaultRoot struct {
+	path string
+	err  error
+	once sync.Once
+}
+
+// defaultWorkspaceRoot returns the dbnet-workspace folder of the user
+// home directory, created once if missing
+func defaultWorkspaceRoot() (string, error) {
+	defaultRoot.once.Do(func() {
+		home, _ := os.UserHomeDir()
+		defaultRoot.path = filepath.Join(home, "dbnet-workspace")
+		defaultRoot.err = os.MkdirAll(defaultRoot.path, 0755)
+	})
+	return defaultRoot.path, defaultRoot.err
+}
+
+// WorkspaceRoots returns the folders the file operations are limited to,
+// from DBNET_WORKSPACE_ROOTS (separated by the OS path list separator).
+// Defaults to the dbnet-workspace folder of the user home directory.
+func WorkspaceRoots() (roots []string) {
+	roots = []string{}
+	val := env.GetVar("DBNET_WORKSPACE_ROOTS")
+	if val == "" {
+		root, err := defaultWorkspaceRoot()
+		if err != nil {
+			g.Warn("could not create default workspace root %s: %s", root, err.Error())
+			return
+		}
+		val = root
+	}
+
+	for _, root := range filepath.SplitList(val) {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		} else if strings.HasPrefix(root, "~") {
+			home, _ := os.UserHomeDir()
+			root = home + root[1:]
+		}
+
+		resolved, err := resolvePath(root)
+		if err != nil {
+			g.Warn("invalid workspace root %s: %s", root, err.Error())
+			continue
+		}
+		roots = append(roots, resolved)
+	}
+	return
+}
+
+// resolvePath returns the absolute path, with the symlinks evaluated.
+// For a path which does not exist yet, the symlinks of the existing
+// parent folder are evaluated.
+func resolvePath(path string) (resolved string, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", g.Error(err, "invalid path %s", path)
+	}
+
+	rest := []string{}
+	for current := path; ; current = filepath.Dir(current) {
+		resolved, err = filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		} else if _, lErr := os.Lstat(current); lErr == nil {
+			// exists but cannot be evaluated, e.g. a dangling symlink
+			return "", g.Error(err, "could not resolve path %s", current)
+		} else if filepath.Dir(current) == current {
+			return "", g.Error(err, "could not resolve path %s", path)
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+	}
+}
+
+// lexicalPath returns the absolute path, with the symlinks of its parent
+// folder evaluated. The last component is kept as is, so that the
+// operations apply to a symlink, and not to its target.
+func lexicalPath(path string) (lexical string, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", g.Error(err, "invalid path %s", path)
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil // file system root
+	}
+
+	parent, err = resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(path)), nil
+}
+
+// isWithin returns true if the path is the folder or inside of it
+func isWithin(path, folder string) bool {
+	rel, err := filepath.Rel(folder, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Resolve resolves the path and target of the request (relative paths
+// are in the first workspace root, a rename target is in the folder of
+// the file), and returns an error if they are outside of the workspace
+// roots, or in the dbNet home folder (credentials).
+func (f *FileRequest) Resolve() (err error) {
+	roots := WorkspaceRoots()
+	if len(roots) == 0 {
+		return g.Error("no workspace roots are configured, set DBNET_WORKSPACE_ROOTS")
+	} else if f.File.Path == "" {
+		return nil // handled by each operation
+	}
+
+	path, root, err := resolveWorkspacePath(f.File.Path, roots)
+	if err != nil {
+		return err
+	} else if path == root && g.In(f.Operation, OperationDelete, OperationRename, OperationMove) {
+		return g.Error("cannot %s the workspace root %s", f.Operation, root)
+	}
+	f.File.Path = path
+
+	if f.Target == "" {
+		return nil // handled by each operation
+	} else if f.Operation == OperationRename {
+		if strings.ContainsAny(f.Target, `/\`) || g.In(f.Target, ".", "..") {
+			return g.Error("invalid name %s, use move to change the folder", f.Target)
+		}
+		f.Target = filepath.Join(filepath.Dir(path), f.Target)
+	}
+
+	f.Target, root, err = resolveWorkspacePath(f.Target, roots)
+	if err != nil {
+		return err
+	} else if f.Target == root {
+		return g.Error("cannot replace the workspace root %s", root)
+	}
+	return nil
+}
+
+// resolveWorkspacePath returns the lexical path to operate on (see
+// lexicalPath), and the workspace root it is in. The path, and the
+// resolved path of a symlink, must be in the workspace roots.
+func resolveWorkspacePath(path string, roots []string) (lexical, root string, err error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(roots[0], path)
+	}
+
+	lexical, err = lexicalPath(path)
+	if err != nil {
+		return "", "", err
+	}
+	resolved, err := resolvePath(lexical)
+	if err != nil {
+		return "", "", err
+	}
+
+	homeDir, homeErr := resolvePath(env.HomeDir)
+	for _, p := range []string{resolved, lexical} {
+		if homeErr == nil && isWithin(p, homeDir) {
+			return "", "", g.Error("path %s is in the dbNet home folder, which is not accessible", path)
+		}
+
+		root = ""
+		for _, r := range roots {
+			if isWithin(p, r) {
+				root = r
+				break
+			}
+		}
+		if root == "" {
+			return "", "", g.Error("path %s is outside of the workspace roots (%s)", path, strings.Join(roots, ", "))
+		}
+	}
+
+	return lexical, root, nil
 }
 
 // Read opens the file
@@ -53,21 +291,27 @@ func (f *FileRequest) Read() (file FileItem, err error) {
 		file.Path = path
 		file.Body = string(bytes)
 		file.ModTs = s.ModTime().Unix()
+		file.Hash = hashContent(bytes)
 	} else {
 		err = g.Error("path %s does not exists", path)
 	}
 	return
 }
 
-// Delete deletes the file
+// Delete deletes the file, or the folder. A folder which
+// is not empty is only deleted if recursive.
 func (f *FileRequest) Delete() (err error) {
 	if f.File.Path == "" {
 		err = g.Error("no path specified for deleting")
 		return
 	}
 
-	if g.PathExists(f.File.Path) {
-		err = os.Remove(f.File.Path)
+	if _, err = os.Lstat(f.File.Path); err == nil {
+		if f.Recursive {
+			err = os.RemoveAll(f.File.Path)
+		} else {
+			err = os.Remove(f.File.Path)
+		}
 		if err != nil {
 			err = g.Error(err, "unable to delete file: %s", f.File.Path)
 			return
@@ -78,55 +322,312 @@ func (f *FileRequest) Delete() (err error) {
 	return
 }
 
-// Write saves the file
+// Write saves the file. Unless overwriting, the hash must match the
+// file on disk (the hash returned by Read or List), otherwise a
+// *FileConflictError is returned. Without a hash, the modification
+// time is compared. The new hash and modification time are set.
 func (f *FileRequest) Write() (err error) {
 	if f.File.Path == "" {
 		err = g.Error("no path specified for saving")
 		return
 	}
-	if g.PathExists(f.File.Path) {
-		s, _ := os.Stat(f.File.Path)
-		if f.File.ModTs < s.ModTime().Unix() && !f.Overwrite {
-			return g.Error("File was modified by another process. Overwrite?")
+
+	fileWriteMux.Lock()
+	defer fileWriteMux.Unlock()
+
+	if !f.Overwrite {
+		if err = f.checkConflict(); err != nil {
+			return err
 		}
 	}
 
 	err = os.WriteFile(f.File.Path, []byte(f.File.Body), 0755)
 	if err != nil {
-		err = g.Error(err, "unable to save file %s", f.File.Path)
+		return g.Error(err, "unable to save file %s", f.File.Path)
+	}
+
+	f.File.Hash = hashContent([]byte(f.File.Body))
+	if s, err := os.Stat(f.File.Path); err == nil {
+		f.File.ModTs = s.ModTime().Unix()
 	}
 	return
 }
 
-// List lists files in a folder
+// checkConflict returns a *FileConflictError if the file
+// was modified or deleted since it was read
+func (f *FileRequest) checkConflict() (err error) {
+	s, err := os.Stat(f.File.Path)
+	if os.IsNotExist(err) {
+		if f.File.Hash != "" {
+			return &FileConflictError{Path: f.File.Path}
+		}
+		return nil // new file
+	} else if err != nil {
+		return g.Error(err, "unable to stat file: %s", f.File.Path)
+	}
+
+	modified := f.File.ModTs < s.ModTime().Unix()
+	if f.File.Hash != "" {
+		hash, err := hashFile(f.File.Path)
+		if err != nil {
+			return err
+		}
+		modified = hash != f.File.Hash
+	}
+	if !modified {
+		return nil
+	}
+
+	current, err := (&FileRequest{File: FileItem{Path: f.File.Path}}).Read()
+	if err != nil {
+		return err
+	}
+	return &FileConflictError{Path: f.File.Path, Exists: true, Current: current}
+}
+
+// listMaxItems is the maximum number of items of a recursive listing
+const listMaxItems = 10000
+
+// List lists files in a folder. If recursive, the sub-folders are
+// listed as well (symlinks are not followed). With globs, only the
+// files with a name or relative path matching a pattern are listed.
+// With git, the status of the changed files of a repository is set.
 func (f *FileRequest) List() (items []FileItem, err error) {
 	if f.File.Path == "" {
 		err = g.Error("no path specified for listing")
 		return
 	}
 
+	for _, glob := range f.Globs {
+		if _, err = filepath.Match(glob, ""); err != nil {
+			return nil, g.Error(err, "invalid glob pattern: %s", glob)
+		}
+	}
+
 	f.File.Path = strings.TrimSuffix(f.File.Path, "/")
-	if g.PathExists(f.File.Path) {
-		var entries []fs.DirEntry
-		entries, err = os.ReadDir(f.File.Path)
+	if !g.PathExists(f.File.Path) {
+		return nil, g.Error("path %s does not exists", f.File.Path)
+	}
+
+	err = filepath.WalkDir(f.File.Path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil && path == f.File.Path {
+			return g.Error(err, "unable to read directory %s", path)
+		} else if err != nil {
+			return nil // skip unreadable sub-folders
+		} else if path == f.File.Path {
+			return nil
+		}
+
+		if !f.matches(path, entry) {
+			// skip
+		} else if len(items) >= listMaxItems {
+			return g.Error("more than %d files in %s, use globs or list the sub-folders", listMaxItems, f.File.Path)
+		} else {
+			items = append(items, newFileItem(path, entry))
+		}
+
+		if entry.IsDir() && !f.Recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	if err != nil || !f.Git {
+		return
+	}
+
+	if codes := gitStatusCodes(f.File.Path); codes != nil {
+		for i := range items {
+			items[i].Git = codes[items[i].Path]
+		}
+	}
+	return
+}
+
+// matches returns true if the entry matches the globs of the request.
+// Folders only match without globs.
+func (f *FileRequest) matches(path string, entry fs.DirEntry) bool {
+	if len(f.Globs) == 0 {
+		return true
+	} else if entry.IsDir() {
+		return false
+	}
+
+	rel, _ := filepath.Rel(f.File.Path, path)
+	for _, glob := range f.Globs {
+		if ok, _ := filepath.Match(glob, entry.Name()); ok {
+			return true
+		} else if ok, _ := filepath.Match(glob, filepath.ToSlash(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newFileItem returns the listed item of the entry, with
+// the hash of files smaller than listHashMaxBytes
+func newFileItem(path string, entry fs.DirEntry) (item FileItem) {
+	item = FileItem{Name: entry.Name(), Path: path, IsDir: entry.IsDir()}
+	if info, err := entry.Info(); err == nil {
+		item.ModTs = info.ModTime().Unix()
+		if info.Mode().IsRegular() && info.Size() <= listHashMaxBytes {
+			item.Hash, _ = hashFile(path)
+		}
+	}
+	return
+}
+
+// Mkdir creates the folder, with its missing parents
+func (f *FileRequest) Mkdir() (file FileItem, err error) {
+	if f.File.Path == "" {
+		return file, g.Error("no path specified for mkdir")
+	}
+
+	if err = os.MkdirAll(f.File.Path, 0755); err != nil {
+		return file, g.Error(err, "unable to create folder %s", f.File.Path)
+	}
+	return f.stat(f.File.Path)
+}
+
+// Move renames or moves the file or folder to the target
+// path. An existing target is only replaced if overwriting.
+func (f *FileRequest) Move() (file FileItem, err error) {
+	if err = f.checkTarget(); err != nil {
+		return
+	}
+
+	err = f.replaceTarget(func() error {
+		if err := os.Rename(f.File.Path, f.Target); err != nil {
+			return g.Error(err, "unable to move %s to %s", f.File.Path, f.Target)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return f.stat(f.Target)
+}
+
+// Copy copies the file, or the folder recursively, to the target
+// path. An existing target is only replaced if overwriting.
+// Symlinks are copied as symlinks.
+func (f *FileRequest) Copy() (file FileItem, err error) {
+	if err = f.checkTarget(); err != nil {
+		return
+	}
+
+	err = f.replaceTarget(f.copyTree)
+	if err != nil {
+		return file, g.Error(err, "unable to copy %s to %s", f.File.Path, f.Target)
+	}
+	return f.stat(f.Target)
+}
+
+// copyTree copies the file, or the folder recursively, to the target path
+func (f *FileRequest) copyTree() error {
+	return filepath.WalkDir(f.File.Path, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			err = g.Error(err, "unable to read directory %s", f.File.Path)
-			return
+			return g.Error(err, "unable to read %s", path)
 		}
 
-		for _, entry := range entries {
-			path := g.F("%s/%s", f.File.Path, entry.Name())
-			info, _ := entry.Info()
-			item := FileItem{
-				Name:  entry.Name(),
-				ModTs: info.ModTime().Unix(),
-				Path:  path,
-				IsDir: entry.IsDir(),
+		rel, _ := filepath.Rel(f.File.Path, path)
+		target := filepath.Join(f.Target, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return g.Error(err, "unable to stat %s", path)
+		}
+
+		switch {
+		case entry.IsDir():
+			err = os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
 			}
-			items = append(items, item)
+		default:
+			err = copyFile(path, target, info.Mode().Perm())
 		}
-	} else {
-		err = g.Error("path %s does not exists", f.File.Path)
+		if err != nil {
+			return g.Error(err, "unable to copy %s", path)
+		}
+		return nil
+	})
+}
+
+// replaceTarget runs fn to create the target. When overwriting, an
+// existing target is moved aside first, and only deleted once fn
+// succeeded, otherwise it is restored.
+func (f *FileRequest) replaceTarget(fn func() error) (err error) {
+	if _, err = os.Lstat(f.Target); !f.Overwrite || os.IsNotExist(err) {
+		return fn()
 	}
-	return
+
+	replaced := filepath.Join(filepath.Dir(f.Target), g.F(".%s.replaced-%d", filepath.Base(f.Target), time.Now().UnixNano()))
+	if err = os.Rename(f.Target, replaced); err != nil {
+		return g.Error(err, "unable to replace %s", f.Target)
+	}
+
+	if err = fn(); err != nil {
+		g.LogError(os.RemoveAll(f.Target), "could not remove partial %s", f.Target)
+		if rErr := os.Rename(replaced, f.Target); rErr != nil {
+			return g.Error(err, "%s could not be restored from %s", f.Target, replaced)
+		}
+		return err
+	}
+
+	if rErr := os.RemoveAll(replaced); rErr != nil {
+		g.Warn("could not delete the replaced %s: %s", replaced, rErr.Error())
+	}
+	return nil
+}
+
+// checkTarget returns an error if the move or copy target is missing,
+// exists (unless overwriting), is inside of the source folder, or
+// contains the source (replacing it would delete the source)
+func (f *FileRequest) checkTarget() (err error) {
+	if f.File.Path == "" {
+		return g.Error("no path specified for %s", f.Operation)
+	} else if f.Target == "" {
+		return g.Error("no target specified for %s", f.Operation)
+	} else if _, err = os.Lstat(f.File.Path); err != nil {
+		return g.Error("path %s does not exists", f.File.Path)
+	} else if isWithin(f.Target, f.File.Path) {
+		return g.Error("cannot %s %s into itself", f.Operation, f.File.Path)
+	} else if isWithin(f.File.Path, f.Target) {
+		return g.Error("cannot %s %s to %s, which contains it", f.Operation, f.File.Path, f.Target)
+	} else if _, err = os.Lstat(f.Target); err == nil && !f.Overwrite {
+		return g.Error("path %s already exists. Overwrite?", f.Target)
+	}
+	return nil
+}
+
+// stat returns the item of the path (of the symlink, not its target)
+func (f *FileRequest) stat(path string) (file FileItem, err error) {
+	s, err := os.Lstat(path)
+	if err != nil {
+		return file, g.Error(err, "unable to stat %s", path)
+	}
+	return FileItem{Name: s.Name(), Path: path, IsDir: s.IsDir(), ModTs: s.ModTime().Unix()}, nil
+}
+
+// copyFile copies the contents of the file
+func copyFile(source, target string, perm fs.FileMode) (err error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
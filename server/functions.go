@@ -1,6 +1,9 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"net/http"
 	"strings"
 	"time"
 
@@ -10,6 +13,7 @@ import (
 	"github.com/flarco/g"
 	"github.com/labstack/echo/v5"
 	"github.com/slingdata-io/sling-cli/core/dbio/iop"
+	"github.com/spf13/cast"
 )
 
 var (
@@ -20,19 +24,156 @@ var (
 	HomeDirEnvFile = ""
 )
 
+// parseTimestamp parses a unix timestamp or a date/time string
+func parseTimestamp(val string) (ts int64, err error) {
+	if val == "" {
+		return 0, nil
+	}
+	if ts, err = cast.ToInt64E(val); err == nil {
+		return ts, nil
+	}
+
+	t, err := cast.ToTimeE(val)
+	if err != nil {
+		return 0, g.Error(err, "could not parse timestamp: %s", val)
+	}
+	return t.Unix(), nil
+}
+
 func queryMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) (err error) {
-		start := time.Now().Unix()
+		start := time.Now()
 		reqErr := next(c) // process to get response
 		if query, ok := c.Get("query").(*dbRestState.Query); ok && query != nil {
 			req := c.Get("request").(*dbRestServer.Request)
-			query.Start = start
+			submitted := query.Start == 0
+			if submitted {
+				query.Start = start.Unix()
+			} else {
+				start = time.Unix(query.Start, 0) // continued, started by a previous request
+			}
+			if c.Response().Status != http.StatusAccepted {
+				recordAudit(auditQuery(c, query, start)) // once finished
+			} else if submitted && !query.IsGenerated {
+				recordAudit(auditQuery(c, query, start)) // still running, may never be continued
+			}
 			go g.LogError(processQuery(req, query), "could not process query")
 		}
 		return reqErr
 	}
 }
 
+// paramsMiddleware renders the typed parameters of the submitted SQL.
+// Values are provided as a JSON object with the `params` query
+// parameter or the `X-Request-Params` header.
+func paramsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		rawParams := c.Request().Header.Get("X-Request-Params")
+		if rawParams == "" {
+			rawParams = c.QueryParam("params")
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return g.ErrJSON(http.StatusBadRequest, err, "could not read request body")
+		}
+		sql := string(body)
+
+		if strings.Contains(sql, "{{") {
+			values := g.M()
+			if rawParams != "" {
+				if err = g.Unmarshal(rawParams, &values); err != nil {
+					return g.ErrJSON(http.StatusBadRequest, err, "could not parse query parameters")
+				}
+			}
+
+			conn, err := dbRestState.DefaultProject().GetConnObject(c.PathParam("connection"), "")
+			if err != nil {
+				return g.ErrJSON(http.StatusBadRequest, err, "could not get connection")
+			}
+
+			sql, err = RenderParams(sql, conn.Type, values)
+			if err != nil {
+				return g.ErrJSON(http.StatusBadRequest, err, "could not render query parameters")
+			}
+		}
+
+		c.Request().Body = io.NopCloser(strings.NewReader(sql))
+		c.Request().ContentLength = int64(len(sql))
+
+		return next(c)
+	}
+}
+
+// Results is the budget of the saved result sets, loaded at start
+var Results = store.ResultsBudget{}
+
+// resultsMiddleware captures the result set streamed to the client,
+// to save it within the results budget
+func resultsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		budget := Results
+		if !budget.IsEnabled() {
+			return next(c)
+		}
+
+		// json records need to be complete to be parsed, allow some headroom
+		capture := &captureWriter{ResponseWriter: c.Response().Writer, max: 2*budget.MaxBytes + 64*1024}
+		c.Response().Writer = capture
+		reqErr := next(c) // process to get response
+		c.Response().Writer = capture.ResponseWriter
+
+		columnsHeader := c.Response().Header().Get("X-Request-Columns")
+		if query, ok := c.Get("query").(*dbRestState.Query); ok && query != nil && c.Response().Status == http.StatusOK && columnsHeader != "" {
+			contentType := c.Response().Header().Get(echo.HeaderContentType)
+			go g.LogError(processResult(budget, query.ID, contentType, columnsHeader, capture), "could not save query result")
+		}
+
+		return reqErr
+	}
+}
+
+// captureWriter copies the response body, up to max bytes
+type captureWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if remaining := cw.max - int64(cw.buf.Len()); remaining < int64(len(b)) {
+		cw.buf.Write(b[:max(remaining, 0)])
+		cw.truncated = true
+	} else {
+		cw.buf.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// prepareMiddleware decrypts the secrets of the requested connection and
+// opens its SSH tunnel, once the access is checked
+func prepareMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		if name := c.PathParam("connection"); name != "" {
+			if err = prepareConnection(name); err != nil {
+				return g.ErrJSON(http.StatusInternalServerError, err, "could not prepare connection")
+			}
+		}
+		return next(c)
+	}
+}
+
 func schemataMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) (err error) {
 		reqErr := next(c) // process to get response
@@ -52,65 +193,100 @@ func processQuery(req *dbRestServer.Request, query *dbRestState.Query) (err erro
 	return store.Sync("queries", query)
 }
 
-func processSchemataData(req *dbRestServer.Request, data *iop.Dataset) (err error) {
-	return
+func processResult(budget store.ResultsBudget, queryID, contentType, columnsHeader string, capture *captureWriter) (err error) {
+	columns := [][]string{} // name, type, db type
+	if err = g.Unmarshal(columnsHeader, &columns); err != nil {
+		return g.Error(err, "could not parse result columns")
+	} else if len(columns) == 0 {
+		return nil // no result set
+	}
 
-	// save to db
-	urlPath := req.URL().Path
+	headers := make([]string, len(columns))
+	for i, col := range columns {
+		headers[i] = col[0]
+	}
 
-	err = store.Conn.Begin()
+	result, err := budget.ParseResult(contentType, headers, capture.buf.Bytes(), capture.truncated)
 	if err != nil {
-		return err
+		return g.Error(err, "could not parse result of query %s", queryID)
 	}
 
-	switch {
-	case strings.HasSuffix(urlPath, "/.tables"):
-		// insert in temp table
-		err = store.Conn.CreateTemporaryTable("temp_table", data.Columns)
-		if err != nil {
-			return err
-		}
+	result.QueryID = queryID
+	return store.SaveQueryResult(&result)
+}
 
-		_, err = store.Conn.InsertBatchStream("temp_table", data.Stream())
-		if err != nil {
+func processSchemataData(req *dbRestServer.Request, data *iop.Dataset) (err error) {
+	urlPath := req.URL().Path
+	isTables := strings.HasSuffix(urlPath, "/.tables")
+	isColumns := strings.HasSuffix(urlPath, "/.columns")
+	if !isTables && !isColumns {
+		return
+	}
 
-		}
+	scope := store.CatalogScope{
+		Connection: strings.ToLower(req.Connection),
+		Database:   strings.ToLower(req.Database),
+		SchemaName: req.Schema,
+		TableName:  req.Table,
+	}
 
-		// depending on level, delete from final table when is not in temp table
-		// insert from temp table into final table
-		// delete from temp table
-		switch {
-		case req.Schema == "":
-			// connection level tables
-			_, err = store.Conn.Exec(`delete from schema_tables where connection = ? and database = ?`, req.Connection, req.Database)
-			if err != nil {
-				return err
-			}
-		case req.Schema != "":
-			// schema level tables
-			_, err = store.Conn.Exec(`delete from schema_tables where connection = ? and database = ? and schema_name = ?`, req.Connection, req.Database, req.Schema)
-			if err != nil {
-				return err
-			}
+	// use the default database of the connection if not provided
+	if scope.Database == "" && req.Project != nil {
+		conn, err := req.Project.GetConnObject(req.Connection, "")
+		if err != nil {
+			return g.Error(err, "could not get connection %s", req.Connection)
 		}
+		scope.Database = strings.ToLower(conn.Info().Database)
+	}
 
-		// insert
+	// save to db
+	switch {
+	case isTables:
+		// connection level or schema level tables
+		tables := []store.SchemaTable{}
+		for _, rec := range data.Records(true) {
+			tables = append(tables, store.SchemaTable{
+				Connection: scope.Connection,
+				Database:   scope.Database,
+				SchemaName: cast.ToString(rec["schema_name"]),
+				TableName:  cast.ToString(rec["table_name"]),
+				IsView:     cast.ToString(rec["table_type"]) == "view",
+			})
+		}
 
-		// err = tx.Exec(...)
+		err = store.ReplaceSchemaTables(scope, tables)
+		if err != nil {
+			return g.Error(err, "could not save tables for %s", scope.Connection)
+		}
 
-	case req.Schema == "" && strings.HasSuffix(urlPath, "/.columns"):
-		// connection level columns
-	case req.Schema != "" && req.Table == "" &&
-		strings.HasSuffix(urlPath, "/.columns"):
-		// schema level columns
-	case req.Schema != "" && req.Table != "" &&
-		strings.HasSuffix(urlPath, "/.columns"):
-		// table level columns
-	}
+	case isColumns:
+		// connection level, schema level or table level columns.
+		// table level columns do not provide the table type
+		tableIsView := false
+		if scope.TableName != "" {
+			table := store.SchemaTable{}
+			scope.Where(store.Db.Model(&table)).Limit(1).Find(&table)
+			tableIsView = table.IsView
+		}
 
-	err = store.Conn.Commit()
-	if err != nil {
+		columns := []store.TableColumn{}
+		for _, rec := range data.Records(true) {
+			columns = append(columns, store.TableColumn{
+				Connection:  scope.Connection,
+				Database:    scope.Database,
+				SchemaName:  cast.ToString(rec["schema_name"]),
+				TableName:   cast.ToString(rec["table_name"]),
+				TableIsView: cast.ToString(rec["table_type"]) == "view" || tableIsView,
+				Name:        cast.ToString(rec["column_name"]),
+				ID:          cast.ToInt(rec["column_id"]),
+				Type:        cast.ToString(rec["column_type"]),
+			})
+		}
 
+		err = store.ReplaceTableColumns(scope, columns)
+		if err != nil {
+			return g.Error(err, "could not save columns for %s", scope.Connection)
+		}
 	}
 
 	return
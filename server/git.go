@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flarco/g"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/binary"
+	gitDiff "github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+type GitOperation string
+
+const (
+	GitOperationStatus   GitOperation = "status"
+	GitOperationDiff     GitOperation = "diff"
+	GitOperationStage    GitOperation = "stage"
+	GitOperationCommit   GitOperation = "commit"
+	GitOperationBranches GitOperation = "branches"
+	GitOperationCheckout GitOperation = "checkout"
+)
+
+// GitRequest is the request struct for the git operations on
+// the repository of a workspace folder
+type GitRequest struct {
+	Operation GitOperation `json:"operation" query:"operation"`
+	Path      string       `json:"path" query:"path"`       // a folder or file in the repository
+	Files     []string     `json:"files" query:"files"`     // the files to diff or stage (default: all changed files)
+	Message   string       `json:"message" query:"message"` // commit message
+	Branch    string       `json:"branch" query:"branch"`   // branch to checkout
+	Create    bool         `json:"create" query:"create"`   // create the branch on checkout
+
+	repo *git.Repository
+	root string   // worktree folder of the repository
+	rels []string // files relative to the root
+}
+
+// GitFileStatus is the status of a changed file, with the git
+// short format codes (e.g. `M`, `A`, `D`, `?`, or a space)
+type GitFileStatus struct {
+	Path     string `json:"path"`
+	Staging  string `json:"staging"`
+	Worktree string `json:"worktree"`
+}
+
+// GitDirtyError is returned when switching branches
+// with changes which are not committed
+type GitDirtyError struct {
+	Files []string
+}
+
+func (e *GitDirtyError) Error() string {
+	return g.F("commit the changes before switching branches (%s)", strings.Join(e.Files, ", "))
+}
+
+// Open resolves the path and files of the request and opens the
+// repository, which must be in the workspace roots.
+func (r *GitRequest) Open() (err error) {
+	roots := WorkspaceRoots()
+	if len(roots) == 0 {
+		return g.Error("no workspace roots are configured, set DBNET_WORKSPACE_ROOTS")
+	} else if r.Path == "" {
+		return g.Error("no path specified for git %s", r.Operation)
+	}
+
+	path, _, err := resolveWorkspacePath(r.Path, roots)
+	if err != nil {
+		return err
+	}
+
+	r.repo, r.root, err = openGitRepo(path)
+	if err != nil {
+		return err
+	} else if _, _, err = resolveWorkspacePath(r.root, roots); err != nil {
+		return g.Error(err, "repository %s is not in the workspace", r.root)
+	}
+
+	r.rels = []string{}
+	for _, file := range r.Files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(r.root, file)
+		}
+		resolved, _, err := resolveWorkspacePath(file, roots)
+		if err != nil {
+			return err
+		} else if !isWithin(resolved, r.root) || resolved == r.root {
+			return g.Error("file %s is not in the repository %s", file, r.root)
+		}
+		rel, _ := filepath.Rel(r.root, resolved)
+		r.rels = append(r.rels, filepath.ToSlash(rel))
+	}
+	return nil
+}
+
+// openGitRepo opens the repository of the path (in a parent folder
+// as well), and returns its worktree folder
+func openGitRepo(path string) (repo *git.Repository, root string, err error) {
+	repo, err = git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, "", g.Error("path %s is not in a git repository", path)
+	} else if err != nil {
+		return nil, "", g.Error(err, "could not open git repository of %s", path)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, "", g.Error(err, "could not open git worktree of %s", path)
+	}
+	return repo, wt.Filesystem.Root(), nil
+}
+
+// gitStatusCodes returns the short format status codes (e.g. ` M`,
+// `A `, `??`) of the changed files of the repository of the folder,
+// by absolute path. Returns nil if the folder is not in a repository.
+func gitStatusCodes(folder string) map[string]string {
+	repo, root, err := openGitRepo(folder)
+	if err != nil {
+		return nil
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil
+	}
+	status, err := wt.Status()
+	if err != nil {
+		g.LogError(err, "could not get git status of %s", root)
+		return nil
+	}
+
+	codes := map[string]string{}
+	for rel, fs := range status {
+		if fs.Staging == git.Unmodified && fs.Worktree == git.Unmodified {
+			continue
+		}
+		codes[filepath.Join(root, filepath.FromSlash(rel))] = string(fs.Staging) + string(fs.Worktree)
+	}
+	return codes
+}
+
+// Status returns the changed files of the repository
+func (r *GitRequest) Status() (files []GitFileStatus, err error) {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return nil, g.Error(err, "could not open git worktree")
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return nil, g.Error(err, "could not get git status of %s", r.root)
+	}
+
+	files = []GitFileStatus{}
+	for rel, fs := range status {
+		if fs.Staging == git.Unmodified && fs.Worktree == git.Unmodified {
+			continue
+		}
+		files = append(files, GitFileStatus{
+			Path:     filepath.Join(r.root, filepath.FromSlash(rel)),
+			Staging:  string(fs.Staging),
+			Worktree: string(fs.Worktree),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// changedFiles returns the files of the request, or
+// all the changed files if none were specified
+func (r *GitRequest) changedFiles() (rels []string, err error) {
+	if len(r.rels) > 0 {
+		return r.rels, nil
+	}
+
+	files, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		rel, _ := filepath.Rel(r.root, file.Path)
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+	return rels, nil
+}
+
+// Diff returns the unified diff of the files in the
+// worktree against the HEAD commit
+func (r *GitRequest) Diff() (text string, err error) {
+	rels, err := r.changedFiles()
+	if err != nil {
+		return "", err
+	}
+
+	var tree *object.Tree
+	if head, err := r.repo.Head(); err == nil {
+		commit, err := r.repo.CommitObject(head.Hash())
+		if err != nil {
+			return "", g.Error(err, "could not get HEAD commit")
+		}
+		if tree, err = commit.Tree(); err != nil {
+			return "", g.Error(err, "could not get HEAD tree")
+		}
+	} else if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return "", g.Error(err, "could not get HEAD")
+	} // else no commit yet
+
+	patch := gitPatch{}
+	for _, rel := range rels {
+		filePatch, err := r.filePatch(tree, rel)
+		if err != nil {
+			return "", err
+		} else if filePatch != nil {
+			patch = append(patch, filePatch)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = diff.NewUnifiedEncoder(&buf, diff.DefaultContextLines).Encode(patch); err != nil {
+		return "", g.Error(err, "could not encode diff")
+	}
+	return buf.String(), nil
+}
+
+// filePatch returns the patch of the file from the HEAD
+// tree to the worktree, or nil if unchanged
+func (r *GitRequest) filePatch(tree *object.Tree, rel string) (patch *gitFilePatch, err error) {
+	patch = &gitFilePatch{}
+
+	var before, after string
+	if tree != nil {
+		if file, err := tree.File(rel); err == nil {
+			patch.from = &gitDiffFile{path: rel, mode: file.Mode, hash: file.Hash}
+			if patch.binary, err = file.IsBinary(); err != nil {
+				return nil, g.Error(err, "could not read %s at HEAD", rel)
+			} else if before, err = file.Contents(); err != nil {
+				return nil, g.Error(err, "could not read %s at HEAD", rel)
+			}
+		} else if !errors.Is(err, object.ErrFileNotFound) {
+			return nil, g.Error(err, "could not get %s at HEAD", rel)
+		}
+	}
+
+	path := filepath.Join(r.root, filepath.FromSlash(rel))
+	if content, err := os.ReadFile(path); err == nil {
+		hash := plumbing.ComputeHash(plumbing.BlobObject, content)
+		patch.to = &gitDiffFile{path: rel, mode: filemode.Regular, hash: hash}
+		if isBinary, _ := binary.IsBinary(bytes.NewReader(content)); isBinary {
+			patch.binary = true
+		}
+		after = string(content)
+	} else if !os.IsNotExist(err) {
+		return nil, g.Error(err, "unable to read file: %s", path)
+	}
+
+	if patch.from == nil && patch.to == nil {
+		return nil, g.Error("file %s does not exist", path)
+	} else if patch.from != nil && patch.to != nil && patch.from.hash == patch.to.hash {
+		return nil, nil
+	} else if patch.binary {
+		return patch, nil
+	}
+
+	for _, d := range gitDiff.Do(before, after) {
+		chunk := gitChunk{content: d.Text, op: diff.Equal}
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			chunk.op = diff.Add
+		case diffmatchpatch.DiffDelete:
+			chunk.op = diff.Delete
+		}
+		patch.chunks = append(patch.chunks, chunk)
+	}
+	return patch, nil
+}
+
+// Stage adds the files of the request (or all the changed
+// files) to the index. Deleted files are removed from it.
+func (r *GitRequest) Stage() (err error) {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return g.Error(err, "could not open git worktree")
+	}
+
+	rels, err := r.changedFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range rels {
+		if _, err = wt.Add(rel); err != nil {
+			return g.Error(err, "could not stage %s", rel)
+		}
+	}
+	return nil
+}
+
+// Commit commits the staged changes with the message, authored by the
+// user, with the user name as email if it is one. Without
+// authentication, the author is the one of the git config.
+func (r *GitRequest) Commit(user *AuthUser) (hash string, err error) {
+	if strings.TrimSpace(r.Message) == "" {
+		return "", g.Error("no message specified for commit")
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return "", g.Error(err, "could not open git worktree")
+	}
+
+	author := &object.Signature{Name: "dbNet", When: time.Now()}
+	if user != nil {
+		// not the git config of the server, which is someone else's
+		author.Name = user.Name
+		if strings.Contains(user.Name, "@") {
+			author.Email = user.Name
+		}
+	} else if cfg, err := r.repo.ConfigScoped(config.GlobalScope); err == nil {
+		if cfg.User.Name != "" {
+			author.Name = cfg.User.Name
+		}
+		author.Email = cfg.User.Email
+	}
+
+	commit, err := wt.Commit(r.Message, &git.CommitOptions{Author: author})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		return "", g.Error("no staged changes to commit")
+	} else if err != nil {
+		return "", g.Error(err, "could not commit")
+	}
+	return commit.String(), nil
+}
+
+// Branches returns the local branches, and the current one
+func (r *GitRequest) Branches() (branches []string, current string, err error) {
+	if head, err := r.repo.Head(); err == nil && head.Name().IsBranch() {
+		current = head.Name().Short()
+	}
+
+	iter, err := r.repo.Branches()
+	if err != nil {
+		return nil, "", g.Error(err, "could not list branches")
+	}
+
+	branches = []string{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		branches = append(branches, ref.Name().Short())
+		return nil
+	})
+	if err != nil {
+		return nil, "", g.Error(err, "could not list branches")
+	}
+
+	sort.Strings(branches)
+	return branches, current, nil
+}
+
+// Checkout switches to the branch, created from HEAD if requested.
+// Returns a *GitDirtyError if tracked files have changes.
+func (r *GitRequest) Checkout() (err error) {
+	if r.Branch == "" {
+		return g.Error("no branch specified for checkout")
+	}
+
+	name := plumbing.NewBranchReferenceName(r.Branch)
+	if err = name.Validate(); err != nil {
+		return g.Error(err, "invalid branch name %s", r.Branch)
+	}
+
+	files, err := r.Status()
+	if err != nil {
+		return err
+	}
+	dirty := &GitDirtyError{}
+	for _, file := range files {
+		if file.Staging != string(git.Untracked) {
+			dirty.Files = append(dirty.Files, file.Path)
+		}
+	}
+	if len(dirty.Files) > 0 {
+		return dirty
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return g.Error(err, "could not open git worktree")
+	}
+
+	err = wt.Checkout(&git.CheckoutOptions{Branch: name, Create: r.Create})
+	if err != nil {
+		return g.Error(err, "could not checkout %s", r.Branch)
+	}
+	return nil
+}
+
+// gitPatch implements diff.Patch for the unified encoder
+type gitPatch []diff.FilePatch
+
+func (p gitPatch) FilePatches() []diff.FilePatch { return p }
+func (p gitPatch) Message() string               { return "" }
+
+type gitFilePatch struct {
+	from, to *gitDiffFile
+	binary   bool
+	chunks   []diff.Chunk
+}
+
+func (p *gitFilePatch) IsBinary() bool { return p.binary }
+
+func (p *gitFilePatch) Files() (from, to diff.File) {
+	// typed nil pointers are not nil interfaces
+	if p.from != nil {
+		from = p.from
+	}
+	if p.to != nil {
+		to = p.to
+	}
+	return
+}
+
+func (p *gitFilePatch) Chunks() []diff.Chunk { return p.chunks }
+
+type gitDiffFile struct {
+	path string
+	mode filemode.FileMode
+	hash plumbing.Hash
+}
+
+func (f *gitDiffFile) Hash() plumbing.Hash     { return f.hash }
+func (f *gitDiffFile) Mode() filemode.FileMode { return f.mode }
+func (f *gitDiffFile) Path() string            { return f.path }
+
+type gitChunk struct {
+	content string
+	op      diff.Operation
+}
+
+func (c gitChunk) Content() string      { return c.content }
+func (c gitChunk) Type() diff.Operation { return c.op }
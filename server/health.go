@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+)
+
+// ConnStatus is the health of a connection, from its last check
+type ConnStatus struct {
+	Conn        string `json:"conn"`
+	Type        string `json:"type"`
+	Healthy     bool   `json:"healthy"`
+	Latency     int64  `json:"latency_ms"` // duration of the last successful check
+	CheckedAt   int64  `json:"checked_at"`
+	HealthyAt   int64  `json:"healthy_at,omitempty"` // last successful check
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorAt int64  `json:"last_error_at,omitempty"`
+}
+
+// HealthMonitor pings the connections periodically
+type HealthMonitor struct {
+	Context  *g.Context
+	statuses map[string]*ConnStatus // by connection name
+	mux      sync.Mutex
+}
+
+// ConnMonitor is the health monitor of the server
+var ConnMonitor = NewHealthMonitor()
+
+// NewHealthMonitor creates a new health monitor
+func NewHealthMonitor() *HealthMonitor {
+	return &HealthMonitor{
+		Context:  g.NewContext(context.Background()),
+		statuses: map[string]*ConnStatus{},
+	}
+}
+
+// healthInterval is the interval between the checks, from
+// DBNET_HEALTH_INTERVAL (seconds, 5 minutes by default, 0 to disable)
+func healthInterval() time.Duration {
+	if val := env.GetVar("DBNET_HEALTH_INTERVAL"); val != "" {
+		return time.Duration(cast.ToInt(val)) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// healthTimeout is the timeout of a check, from
+// DBNET_HEALTH_TIMEOUT (seconds, 10 by default)
+func healthTimeout() time.Duration {
+	if val := cast.ToInt(env.GetVar("DBNET_HEALTH_TIMEOUT")); val > 0 {
+		return time.Duration(val) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// Loop checks all the connections at every interval, until stopped
+func (hm *HealthMonitor) Loop() {
+	interval := healthInterval()
+	if interval <= 0 {
+		g.Debug("connection health checks are disabled")
+		return
+	}
+
+	for {
+		hm.CheckAll()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-hm.Context.Ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop stops the loop
+func (hm *HealthMonitor) Stop() {
+	hm.Context.Cancel()
+}
+
+// CheckAll checks the database connections concurrently,
+// and forgets the connections which were removed
+func (hm *HealthMonitor) CheckAll() (statuses []ConnStatus) {
+	names := dbConnNames()
+
+	hm.mux.Lock()
+	for name := range hm.statuses {
+		if !g.In(name, names...) {
+			delete(hm.statuses, name)
+		}
+	}
+	hm.mux.Unlock()
+
+	return hm.Check(names...)
+}
+
+// dbConnNames returns the names of the database connections
+func dbConnNames() (names []string) {
+	names = []string{}
+	for _, entry := range localConns() {
+		if entry.Connection.Type.IsDb() {
+			names = append(names, strings.ToUpper(entry.Name))
+		}
+	}
+	return names
+}
+
+// Check checks the connections concurrently
+func (hm *HealthMonitor) Check(names ...string) (statuses []ConnStatus) {
+	var wg sync.WaitGroup
+	upperNames := make([]string, len(names))
+	for i, name := range names {
+		upperNames[i] = strings.ToUpper(name)
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			hm.check(name)
+		}(upperNames[i])
+	}
+	wg.Wait()
+
+	return hm.Statuses(upperNames...)
+}
+
+// check pings the connection, and records the result
+func (hm *HealthMonitor) check(name string) {
+	entry := localConns().Get(name)
+
+	start := time.Now()
+	latency, err := pingConnection(hm.Context.Ctx, name, healthTimeout())
+
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+
+	status, ok := hm.statuses[name]
+	if !ok {
+		status = &ConnStatus{Conn: name}
+		hm.statuses[name] = status
+	}
+
+	status.Type = entry.Connection.Type.String()
+	status.Healthy = err == nil
+	status.CheckedAt = start.Unix()
+	if err != nil {
+		status.LastError = g.ErrMsgSimple(err)
+		status.LastErrorAt = start.Unix()
+		g.Debug("connection %s is unhealthy: %s", name, status.LastError)
+	} else {
+		status.Latency = latency.Milliseconds()
+		status.HealthyAt = start.Unix()
+	}
+}
+
+// Statuses returns the last checks of the connections (all if none
+// specified). Connections not checked yet are not included.
+func (hm *HealthMonitor) Statuses(names ...string) (statuses []ConnStatus) {
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+
+	statuses = []ConnStatus{}
+	for name, status := range hm.statuses {
+		if len(names) == 0 || g.In(name, names...) {
+			statuses = append(statuses, *status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Conn < statuses[j].Conn
+	})
+	return statuses
+}
+
+// pingConnection connects and pings the database, and returns
+// the duration. Gives up after the timeout.
+func pingConnection(ctx context.Context, name string, timeout time.Duration) (latency time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		conn, err := GetConnInstance(name, "")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		// connections without sql driver are checked when connecting
+		if db := conn.Db(); db != nil {
+			if err = db.PingContext(ctx); err != nil {
+				done <- result{err: g.Error(err, "could not ping %s", name)}
+				return
+			}
+		}
+		done <- result{latency: time.Since(start)}
+	}()
+
+	select {
+	case r := <-done:
+		return r.latency, r.err
+	case <-ctx.Done():
+		return 0, g.Error("connection %s timed out after %s", name, timeout)
+	}
+}
+
+// GetConnectionStatus returns the health of the connections the user
+// can read. With `refresh`, they are checked first (only those).
+func GetConnectionStatus(c echo.Context) (err error) {
+	user := GetAuthUser(c)
+
+	// only the defined database connections are checked
+	names := []string{}
+	if requested := splitList(c.QueryParam("conn")); len(requested) > 0 {
+		defined := dbConnNames()
+		for _, name := range requested {
+			name = strings.ToUpper(name)
+			if lo.Contains(defined, name) && CheckAccess(user, name, "", AccessRead) == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	if c.QueryParam("conn") != "" && len(names) == 0 {
+		return c.JSON(http.StatusOK, g.M("connections", []ConnStatus{}))
+	}
+
+	var statuses []ConnStatus
+	if refresh := cast.ToBool(c.QueryParam("refresh")); refresh && len(names) > 0 {
+		statuses = ConnMonitor.Check(names...)
+	} else if refresh {
+		readable := []string{}
+		for _, name := range dbConnNames() {
+			if CheckAccess(user, name, "", AccessRead) == nil {
+				readable = append(readable, name)
+			}
+		}
+		statuses = ConnMonitor.Check(readable...)
+	} else {
+		statuses = ConnMonitor.Statuses(names...)
+	}
+
+	allowed := []ConnStatus{}
+	for _, status := range statuses {
+		if CheckAccess(user, status.Conn, "", AccessRead) == nil {
+			allowed = append(allowed, status)
+		}
+	}
+
+	return c.JSON(http.StatusOK, g.M("connections", allowed))
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/store"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/spf13/cast"
+)
+
+// JobTypeSchedule is the type of the jobs run from a schedule
+const JobTypeSchedule = "schedule"
+
+// Scheduler runs the job schedules when due.
+// Schedules are reloaded from the store every minute, so
+// changes made with the CLI are picked up by a running server.
+type Scheduler struct {
+	Context *g.Context
+}
+
+// runningStale is the time after which the heartbeat of a running job
+// is considered stale (e.g. the process was killed), and the schedule
+// can run again
+const runningStale = 5 * time.Minute
+
+// JobScheduler is the scheduler of the server
+var JobScheduler = NewScheduler()
+
+// NewScheduler creates a new scheduler
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		Context: g.NewContext(context.Background()),
+	}
+}
+
+// Loop checks the due schedules every minute, until stopped
+func (s *Scheduler) Loop() {
+	for {
+		s.tick(time.Now())
+
+		// wake up at the start of the next minute
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-s.Context.Ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop stops the loop and cancels the running jobs
+func (s *Scheduler) Stop() {
+	s.Context.Cancel()
+}
+
+// tick runs the schedules due at `now`
+func (s *Scheduler) tick(now time.Time) {
+	schedules := []store.JobSchedule{}
+	err := store.Db.Where("paused = ? and next_run > 0 and next_run <= ?", false, now.Unix()).
+		Find(&schedules).Error
+	if err != nil {
+		g.LogError(g.Error(err, "could not load job schedules"))
+		return
+	}
+
+	for _, schedule := range schedules {
+		missed := schedule.NextRun < now.Truncate(time.Minute).Unix()
+
+		if err = s.reschedule(&schedule, now); err != nil {
+			g.LogError(err)
+			continue
+		}
+
+		if missed {
+			// like cron, do not catch up runs missed while the server was down
+			g.Debug("skipping missed run of job schedule %s", schedule.ID)
+			continue
+		}
+
+		go func(schedule store.JobSchedule) {
+			if _, err := s.Run(schedule, "cron"); err != nil {
+				g.LogError(err)
+			}
+		}(schedule)
+	}
+}
+
+// reschedule sets the next run of the schedule after `now`
+func (s *Scheduler) reschedule(schedule *store.JobSchedule, now time.Time) (err error) {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return g.Error(err, "invalid cron of job schedule %s", schedule.ID)
+	}
+
+	schedule.NextRun = 0
+	if next := cron.Next(now); !next.IsZero() {
+		schedule.NextRun = next.Unix()
+	}
+
+	err = store.Db.Model(schedule).Update("next_run", schedule.NextRun).Error
+	if err != nil {
+		return g.Error(err, "could not update next run of job schedule %s", schedule.ID)
+	}
+	return
+}
+
+// IsRunning returns true if the schedule has a job running,
+// in this process or another one (e.g. `dbnet jobs run`)
+func (s *Scheduler) IsRunning(scheduleID string) bool {
+	var count int64
+	store.Db.Model(&store.JobSchedule{}).
+		Where("id = ? and running_at >= ?", scheduleID, time.Now().Add(-runningStale).Unix()).
+		Count(&count)
+	return count > 0
+}
+
+// claim marks the schedule as running, and keeps its heartbeat until
+// released. Returns an error if it is already running, in this
+// process or another one sharing the store.
+func (s *Scheduler) claim(scheduleID string) (release func(), err error) {
+	res := store.Db.Model(&store.JobSchedule{}).
+		Where("id = ? and running_at < ?", scheduleID, time.Now().Add(-runningStale).Unix()).
+		Update("running_at", time.Now().Unix())
+	if res.Error != nil {
+		return nil, g.Error(res.Error, "could not claim job schedule %s", scheduleID)
+	} else if res.RowsAffected == 0 {
+		return nil, g.Error("job schedule %s is already running", scheduleID)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(runningStale / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				store.Db.Model(&store.JobSchedule{}).Where("id = ?", scheduleID).Update("running_at", time.Now().Unix())
+			}
+		}
+	}()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(done)
+			err := store.Db.Model(&store.JobSchedule{}).Where("id = ?", scheduleID).Update("running_at", 0).Error
+			g.LogError(err, "could not release job schedule %s", scheduleID)
+		})
+	}
+	return release, nil
+}
+
+// Run executes the saved query of the schedule and records the run
+// as a job. The trigger is `cron` or `manual`. A schedule cannot
+// have overlapping runs, across the processes sharing the store.
+func (s *Scheduler) Run(schedule store.JobSchedule, trigger string) (job *store.Job, err error) {
+	release, err := s.claim(schedule.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+	job = &store.Job{
+		ID:      g.NewTsID("job"),
+		Type:    JobTypeSchedule,
+		Time:    start.Unix(),
+		Request: g.M("schedule_id", schedule.ID, "saved_query_id", schedule.SavedQueryID, "trigger", trigger),
+		Result:  g.M("status", "running"),
+	}
+	if err = store.Sync("jobs", job); err != nil {
+		return nil, g.Error(err, "could not save job")
+	}
+
+	err = store.Db.Model(&schedule).Update("last_run", job.Time).Error
+	if err != nil {
+		g.LogError(g.Error(err, "could not update last run of job schedule %s", schedule.ID))
+	}
+
+	affected, err := s.execute(schedule, job.Request)
+
+	job.Duration = time.Since(start).Seconds()
+	job.Result = g.M("status", "success", "rows_affected", affected)
+	if err != nil {
+		job.Err = err.Error()
+		job.Result["status"] = "error"
+	}
+
+	if sErr := store.Sync("jobs", job); sErr != nil {
+		g.LogError(g.Error(sErr, "could not save job %s", job.ID))
+	}
+
+	recordAudit(&store.AuditEvent{
+		Time:         job.Time,
+		User:         "job:" + schedule.ID,
+		Action:       AuditSQL,
+		Conn:         strings.ToLower(cast.ToString(job.Request["conn"])),
+		Database:     strings.ToLower(cast.ToString(job.Request["database"])),
+		QueryID:      job.ID,
+		Text:         cast.ToString(job.Request["text"]),
+		Status:       cast.ToString(job.Result["status"]),
+		Err:          job.Err,
+		RowsAffected: affected,
+		Duration:     job.Duration,
+	})
+
+	return
+}
+
+// execute renders and runs the saved query of the schedule.
+// The connection and rendered text are added to the request.
+func (s *Scheduler) execute(schedule store.JobSchedule, request g.Map) (affected int64, err error) {
+	savedQuery := store.SavedQuery{}
+	err = store.Db.Where("id = ?", schedule.SavedQueryID).Limit(1).Find(&savedQuery).Error
+	if err != nil {
+		return 0, g.Error(err, "could not get saved query %s", schedule.SavedQueryID)
+	} else if savedQuery.ID == "" {
+		return 0, g.Error("saved query %s not found", schedule.SavedQueryID)
+	} else if savedQuery.Conn == "" {
+		return 0, g.Error("saved query %s has no connection", schedule.SavedQueryID)
+	}
+
+	request["conn"] = savedQuery.Conn
+	request["database"] = savedQuery.Database
+
+	connObj, err := dbRestState.DefaultProject().GetConnObject(savedQuery.Conn, "")
+	if err != nil {
+		return 0, g.Error(err, "could not get connection %s", savedQuery.Conn)
+	}
+
+	sql, err := RenderParams(savedQuery.Text, connObj.Type, schedule.Params)
+	if err != nil {
+		return 0, g.Error(err, "could not render query parameters")
+	}
+	request["text"] = sql
+
+	owner, err := jobOwner(schedule)
+	if err != nil {
+		return 0, err
+	} else if err = CheckSQLAccess(owner, savedQuery.Conn, sql); err != nil {
+		return 0, g.Error(err, "owner %s cannot run saved query %s", schedule.Owner, savedQuery.ID)
+	}
+
+	// in the queue of the connection, as the queries of the users
+	release, err := acquireSlot(s.Context.Ctx, savedQuery.Conn, savedQuery.Database, "job:"+schedule.ID, schedule.Owner)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	conn, err := GetConnInstance(savedQuery.Conn, savedQuery.Database)
+	if err != nil {
+		return 0, g.Error(err, "could not get connection %s", savedQuery.Conn)
+	}
+
+	result, err := conn.ExecMultiContext(s.Context.Ctx, sql)
+	if err != nil {
+		return 0, g.Error(err, "could not execute saved query %s", savedQuery.ID)
+	}
+
+	if result != nil {
+		affected, _ = result.RowsAffected()
+	}
+	return
+}
+
+// jobOwner returns the user whose grants apply to the runs of the
+// schedule, or nil if none. Local users are reloaded, to apply
+// their current groups.
+func jobOwner(schedule store.JobSchedule) (owner *AuthUser, err error) {
+	if schedule.Owner == "" {
+		return nil, nil
+	} else if schedule.OwnerAuth != "password" {
+		return &AuthUser{Name: schedule.Owner, Groups: schedule.OwnerGroups, Provider: schedule.OwnerAuth}, nil
+	}
+
+	user := store.User{}
+	err = store.Db.Where("name = ?", schedule.Owner).Limit(1).Find(&user).Error
+	if err != nil {
+		return nil, g.Error(err, "could not get owner %s", schedule.Owner)
+	} else if user.Name == "" {
+		return nil, g.Error("owner %s of job schedule %s no longer exists", schedule.Owner, schedule.ID)
+	}
+	return &AuthUser{Name: user.Name, Groups: user.Groups, Provider: "password"}, nil
+}
+
+// SaveJobSchedule validates and saves the schedule, and computes its next run
+func SaveJobSchedule(schedule *store.JobSchedule) (err error) {
+	schedule.Name = strings.TrimSpace(schedule.Name)
+	if schedule.SavedQueryID == "" {
+		return g.Error("missing saved query id")
+	}
+
+	savedQuery := store.SavedQuery{}
+	err = store.Db.Where("id = ?", schedule.SavedQueryID).Limit(1).Find(&savedQuery).Error
+	if err != nil {
+		return g.Error(err, "could not get saved query %s", schedule.SavedQueryID)
+	} else if savedQuery.ID == "" {
+		return g.Error("saved query %s not found", schedule.SavedQueryID)
+	}
+
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return err
+	}
+	schedule.Cron = cron.Expr
+
+	if schedule.Params == nil {
+		schedule.Params = g.M()
+	}
+	if schedule.Name == "" {
+		schedule.Name = savedQuery.Name
+	}
+	if schedule.ID == "" {
+		schedule.ID = g.NewTsID("sched")
+	} else {
+		// keep the run state when updating
+		existing := store.JobSchedule{}
+		store.Db.Where("id = ?", schedule.ID).Limit(1).Find(&existing)
+		schedule.LastRun, schedule.RunningAt = existing.LastRun, existing.RunningAt
+	}
+
+	schedule.NextRun = 0
+	if next := cron.Next(time.Now()); !next.IsZero() {
+		schedule.NextRun = next.Unix()
+	}
+
+	return store.Sync("job_schedules", schedule)
+}
+
+// PauseJobSchedule pauses or resumes a schedule.
+// When resumed, the next run is computed from now.
+func PauseJobSchedule(id string, paused bool) (schedule store.JobSchedule, err error) {
+	err = store.Db.Where("id = ?", id).Limit(1).Find(&schedule).Error
+	if err != nil {
+		return schedule, g.Error(err, "could not get job schedule %s", id)
+	} else if schedule.ID == "" {
+		return schedule, g.Error("job schedule %s not found", id)
+	}
+
+	schedule.Paused = paused
+	err = store.Db.Model(&schedule).Update("paused", paused).Error
+	if err != nil {
+		return schedule, g.Error(err, "could not update job schedule %s", id)
+	}
+
+	if !paused {
+		err = JobScheduler.reschedule(&schedule, time.Now())
+	}
+	return
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/spf13/cast"
+)
+
+// ConnLimits are the limits of a connection, from its `max_queries`,
+// `max_sessions` and `queue_timeout` properties, or the
+// DBNET_CONN_MAX_QUERIES, DBNET_CONN_MAX_SESSIONS and
+// DBNET_CONN_QUEUE_TIMEOUT variables. 0 is unlimited. The queries
+// are capped to the sessions, so that they wait in the queue rather
+// than for a session.
+type ConnLimits struct {
+	MaxQueries   int           // concurrent queries, the others are queued
+	MaxSessions  int           // open database sessions
+	QueueTimeout time.Duration // time to wait in the queue
+}
+
+// QueueEntry is a query waiting for a connection
+type QueueEntry struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"` // 1 is next
+	User     string `json:"user,omitempty"`
+	QueuedAt int64  `json:"queued_at"`
+
+	ready     chan struct{} // closed when the query can run
+	cancelled bool
+}
+
+// ConnQueue is the status of the queries of a connection
+type ConnQueue struct {
+	Conn       string       `json:"conn"`
+	MaxQueries int          `json:"max_queries"`
+	Running    int          `json:"running"`
+	Queued     []QueueEntry `json:"queued"`
+}
+
+// ConnLimiter caps the concurrent queries of a connection. Queries
+// over the cap wait in a FIFO queue, and each finished query hands
+// its slot to the next one.
+type ConnLimiter struct {
+	running int
+	held    map[string]heldQuery // queries still running after their request, by ID
+	queue   []*QueueEntry
+	mux     sync.Mutex
+}
+
+// heldQuery is a query still running after its request
+type heldQuery struct {
+	query  *dbRestState.Query
+	heldAt time.Time
+}
+
+// ConnBusyError is returned when no slot of the connection
+// could be acquired
+type ConnBusyError struct {
+	Conn string
+	Err  error
+}
+
+func (e *ConnBusyError) Error() string {
+	return g.F("connection %s is busy: %s", strings.ToUpper(e.Conn), e.Err.Error())
+}
+
+var (
+	limiters    = map[string]*ConnLimiter{} // by connection name
+	limitersMux sync.Mutex
+)
+
+// heldTimeout is the time after which a query still running after its
+// request, and not continued since, is cancelled and releases its slot.
+// dbREST replies after 90 seconds, a client still waiting for the query
+// continues it right away.
+const heldTimeout = 3 * time.Minute
+
+// GetConnLimits returns the limits of the connection
+func GetConnLimits(name string) (limits ConnLimits) {
+	limits = ConnLimits{
+		MaxQueries:   cast.ToInt(env.GetVar("DBNET_CONN_MAX_QUERIES")),
+		MaxSessions:  cast.ToInt(env.GetVar("DBNET_CONN_MAX_SESSIONS")),
+		QueueTimeout: 60 * time.Second,
+	}
+	if val := env.GetVar("DBNET_CONN_QUEUE_TIMEOUT"); val != "" {
+		limits.QueueTimeout = time.Duration(cast.ToInt(val)) * time.Second
+	}
+
+	conn, err := dbRestState.DefaultProject().GetConnObject(name, "")
+	if err != nil {
+		return limits
+	}
+	if val, ok := conn.Data["max_queries"]; ok {
+		limits.MaxQueries = cast.ToInt(val)
+	}
+	if val, ok := conn.Data["max_sessions"]; ok {
+		limits.MaxSessions = cast.ToInt(val)
+	}
+	if val, ok := conn.Data["queue_timeout"]; ok {
+		limits.QueueTimeout = time.Duration(cast.ToInt(val)) * time.Second
+	}
+
+	if limits.MaxSessions > 0 && (limits.MaxQueries <= 0 || limits.MaxQueries > limits.MaxSessions) {
+		limits.MaxQueries = limits.MaxSessions
+	}
+	return limits
+}
+
+// GetConnLimiter returns the limiter of the connection
+func GetConnLimiter(name string) *ConnLimiter {
+	name = strings.ToUpper(name)
+
+	limitersMux.Lock()
+	defer limitersMux.Unlock()
+
+	limiter, ok := limiters[name]
+	if !ok {
+		limiter = &ConnLimiter{held: map[string]heldQuery{}}
+		limiters[name] = limiter
+	}
+	return limiter
+}
+
+// Acquire waits for a slot to run the query, in order of arrival.
+// Gives up after the timeout (none if 0), or when the context is done.
+func (cl *ConnLimiter) Acquire(ctx context.Context, id, user string, max int, timeout time.Duration) (err error) {
+	cl.mux.Lock()
+	cl.expireHeld()
+	if cl.running < max && len(cl.queue) == 0 {
+		cl.running++
+		cl.mux.Unlock()
+		return nil
+	}
+
+	entry := &QueueEntry{ID: id, User: user, QueuedAt: time.Now().Unix(), ready: make(chan struct{})}
+	cl.queue = append(cl.queue, entry)
+	cl.mux.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-entry.ready:
+	case <-expired:
+		err = g.Error("timed out after %s in the queue, %d queries are running", timeout, max)
+	case <-ctx.Done():
+		err = g.Error("request was closed while in the queue")
+	}
+
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	if entry.cancelled {
+		return g.Error("query %s was cancelled while in the queue", id)
+	} else if err != nil && cl.remove(entry) {
+		return err
+	}
+	return nil // ready, possibly right as it expired
+}
+
+// Release hands the slot to the next query in the queue
+func (cl *ConnLimiter) Release() {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cl.release()
+}
+
+func (cl *ConnLimiter) release() {
+	if len(cl.queue) > 0 {
+		next := cl.queue[0]
+		cl.queue = cl.queue[1:]
+		close(next.ready)
+		return
+	}
+	cl.running--
+}
+
+// Hold keeps the slot of a query still running after its request.
+// It is released when the query is continued to its end, or cancelled.
+func (cl *ConnLimiter) Hold(query *dbRestState.Query) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cl.held[query.ID] = heldQuery{query: query, heldAt: time.Now()}
+}
+
+// Resume takes back the slot held by the query. Returns false
+// if the query does not hold one.
+func (cl *ConnLimiter) Resume(id string) bool {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	_, ok := cl.held[id]
+	delete(cl.held, id)
+	return ok
+}
+
+// Cancel removes the query from the queue, or releases its held slot.
+// Returns true if the query was queued.
+func (cl *ConnLimiter) Cancel(id string) (queued bool) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+
+	if _, ok := cl.held[id]; ok {
+		delete(cl.held, id)
+		cl.release()
+	}
+
+	for _, entry := range cl.queue {
+		if entry.ID == id && cl.remove(entry) {
+			entry.cancelled = true
+			close(entry.ready)
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes the entry from the queue. Returns false if not queued.
+func (cl *ConnLimiter) remove(entry *QueueEntry) bool {
+	for i, e := range cl.queue {
+		if e == entry {
+			cl.queue = append(cl.queue[:i], cl.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// expireHeld cancels the queries not continued in time, still using
+// a session, and releases their slots
+func (cl *ConnLimiter) expireHeld() {
+	for id, held := range cl.held {
+		if time.Since(held.heldAt) > heldTimeout {
+			g.Debug("cancelling query %s, not continued since %s", id, held.heldAt.Format(time.RFC3339))
+			go held.query.Cancel() // not found once finished
+			delete(cl.held, id)
+			cl.release()
+		}
+	}
+}
+
+// Status returns the running and queued queries
+func (cl *ConnLimiter) Status() (running int, queued []QueueEntry) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+
+	cl.expireHeld()
+	queued = make([]QueueEntry, len(cl.queue))
+	for i, entry := range cl.queue {
+		queued[i] = *entry
+		queued[i].Position = i + 1
+	}
+	return cl.running, queued
+}
+
+// limitsMiddleware caps the concurrent queries of the connection. The
+// request waits in the queue for a slot, which is kept until the query
+// is fetched: a query still running after its request (202) keeps its
+// slot until it is continued to its end.
+func limitsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		name := c.PathParam("connection")
+		limits := GetConnLimits(name)
+		if limits.MaxQueries <= 0 {
+			return next(c)
+		}
+
+		limiter := GetConnLimiter(name)
+		id := c.PathParam("id")
+		if id == "" {
+			id = c.QueryParam("id")
+		}
+
+		if c.Request().Header.Get("X-Request-Continue") == "" || !limiter.Resume(id) {
+			user := ""
+			if u := GetAuthUser(c); u != nil {
+				user = u.Name
+			}
+			if err = limiter.Acquire(c.Request().Context(), id, user, limits.MaxQueries, limits.QueueTimeout); err != nil {
+				return g.ErrJSON(http.StatusServiceUnavailable, err, "connection %s is busy", name)
+			} else if err = applySessionLimit(name, c.QueryParam("database"), limits); err != nil {
+				limiter.Release()
+				return g.ErrJSON(http.StatusInternalServerError, err, "could not limit sessions")
+			}
+		}
+
+		reqErr := next(c) // process to get response
+
+		query, _ := c.Get("query").(*dbRestState.Query)
+		if c.Response().Status == http.StatusAccepted && query != nil && !query.IsGenerated {
+			limiter.Hold(query) // still running
+		} else {
+			limiter.Release()
+		}
+
+		return reqErr
+	}
+}
+
+// cancelLimitsMiddleware cancels the query in the queue, or releases
+// the slot it holds
+func cancelLimitsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		id := c.PathParam("id")
+		if id == "" {
+			id = c.QueryParam("id")
+		}
+
+		if id != "" && GetConnLimiter(c.PathParam("connection")).Cancel(id) {
+			return c.JSON(http.StatusOK, g.M())
+		}
+		return next(c)
+	}
+}
+
+// acquireSlot waits for a slot to run a query outside of a request
+// (detached queries and jobs), and applies the session limit. The
+// returned function releases the slot.
+func acquireSlot(ctx context.Context, name, database, id, user string) (release func(), err error) {
+	release = func() {}
+	limits := GetConnLimits(name)
+	if limits.MaxQueries <= 0 {
+		return release, nil
+	}
+
+	limiter := GetConnLimiter(name)
+	if err = limiter.Acquire(ctx, id, user, limits.MaxQueries, limits.QueueTimeout); err != nil {
+		return release, &ConnBusyError{Conn: name, Err: err}
+	} else if err = applySessionLimit(name, database, limits); err != nil {
+		limiter.Release()
+		return release, g.Error(err, "could not limit sessions")
+	}
+
+	var once sync.Once
+	return func() { once.Do(limiter.Release) }, nil
+}
+
+// applySessionLimit sets the maximum of open sessions of the
+// connection database, once the query has its slot. Pooled databases
+// are shared by the connections with the same URL.
+func applySessionLimit(name, database string, limits ConnLimits) (err error) {
+	if limits.MaxSessions <= 0 {
+		return nil
+	}
+
+	conn, err := GetConnInstance(name, database)
+	if err != nil {
+		return g.Error(err, "could not get connection %s", name)
+	}
+	if db := conn.Db(); db != nil {
+		db.SetMaxOpenConns(limits.MaxSessions)
+		db.SetMaxIdleConns(limits.MaxSessions)
+	}
+	return nil
+}
+
+// GetConnectionQueue returns the running and queued queries of the
+// connections the user can read (with `conn`, only those)
+func GetConnectionQueue(c echo.Context) (err error) {
+	user := GetAuthUser(c)
+
+	names := []string{}
+	if c.QueryParam("conn") != "" {
+		names = splitList(c.QueryParam("conn"))
+	} else {
+		limitersMux.Lock()
+		for name := range limiters {
+			names = append(names, name)
+		}
+		limitersMux.Unlock()
+	}
+	sort.Strings(names)
+
+	queues := []ConnQueue{}
+	for _, name := range names {
+		if CheckAccess(user, name, "", AccessRead) != nil {
+			continue
+		}
+
+		queue := ConnQueue{Conn: strings.ToUpper(name), MaxQueries: GetConnLimits(name).MaxQueries}
+		queue.Running, queue.Queued = GetConnLimiter(name).Status()
+		queues = append(queues, queue)
+	}
+
+	return c.JSON(http.StatusOK, g.M("connections", queues))
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flarco/g"
+	"github.com/slingdata-io/sling-cli/core/dbio"
+	"github.com/spf13/cast"
+)
+
+// ParamType is the type of a query parameter
+type ParamType string
+
+const (
+	ParamTypeString    ParamType = "string"
+	ParamTypeInt       ParamType = "int"
+	ParamTypeFloat     ParamType = "float"
+	ParamTypeBool      ParamType = "bool"
+	ParamTypeDate      ParamType = "date"
+	ParamTypeTimestamp ParamType = "timestamp"
+)
+
+// paramAliases are the accepted type names
+var paramAliases = map[string]ParamType{
+	"string":    ParamTypeString,
+	"text":      ParamTypeString,
+	"int":       ParamTypeInt,
+	"integer":   ParamTypeInt,
+	"float":     ParamTypeFloat,
+	"number":    ParamTypeFloat,
+	"decimal":   ParamTypeFloat,
+	"bool":      ParamTypeBool,
+	"boolean":   ParamTypeBool,
+	"date":      ParamTypeDate,
+	"datetime":  ParamTypeTimestamp,
+	"timestamp": ParamTypeTimestamp,
+}
+
+// paramRegex matches `{{name}}`, `{{name:type}}` or `{{name:type[]}}`
+var paramRegex = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*(?::\s*([A-Za-z]+)\s*(\[\])?)?\s*\}\}`)
+
+// Param is a typed parameter declared in a query
+type Param struct {
+	Name    string    `json:"name"`
+	Type    ParamType `json:"type"`
+	IsArray bool      `json:"is_array"`
+}
+
+// ParseParams returns the parameters declared in the sql text
+func ParseParams(sql string) (params []Param, err error) {
+	return parseParams(sql, false)
+}
+
+// findParams returns the positions of the parameter declarations
+// (see regexp.FindAllStringSubmatchIndex), skipping those in string
+// literals and comments. With backslash, a backslash escapes the
+// next character in strings.
+func findParams(sql string, backslash bool) (matches [][]int, err error) {
+	tokens, err := tokenizeSQL(sql, backslash)
+	if err != nil {
+		return nil, g.Error(err, "could not parse sql")
+	}
+
+	matches = [][]int{}
+	for _, match := range paramRegex.FindAllStringSubmatchIndex(sql, -1) {
+		inLiteral := false
+		for _, token := range tokens {
+			if (token.Kind == tokenString || token.Kind == tokenComment) && match[0] >= token.Start && match[0] < token.End {
+				inLiteral = true
+				break
+			}
+		}
+		if !inLiteral {
+			matches = append(matches, match)
+		}
+	}
+	return
+}
+
+func parseParams(sql string, backslash bool) (params []Param, err error) {
+	params = []Param{}
+	if !strings.Contains(sql, "{{") {
+		return
+	}
+
+	matches, err := findParams(sql, backslash)
+	if err != nil {
+		return params, err
+	}
+
+	seen := map[string]Param{}
+	for _, index := range matches {
+		match := make([]string, len(index)/2)
+		for i := range match {
+			if index[2*i] >= 0 {
+				match[i] = sql[index[2*i]:index[2*i+1]]
+			}
+		}
+
+		param := Param{Name: match[1], Type: ParamTypeString, IsArray: match[3] != ""}
+		if match[2] != "" {
+			pType, ok := paramAliases[strings.ToLower(match[2])]
+			if !ok {
+				return params, g.Error("invalid type '%s' for parameter '%s'", match[2], param.Name)
+			}
+			param.Type = pType
+		}
+
+		if prev, ok := seen[param.Name]; ok {
+			if prev != param {
+				return params, g.Error("parameter '%s' is declared with different types", param.Name)
+			}
+			continue
+		}
+		seen[param.Name] = param
+		params = append(params, param)
+	}
+	return
+}
+
+// RenderParams validates the values and replaces the declared
+// parameters with literals quoted for the dialect of the connection
+func RenderParams(sql string, connType dbio.Type, values map[string]any) (rendered string, err error) {
+	params, err := parseParams(sql, backslashDialects[connType])
+	if err != nil {
+		return sql, err
+	} else if len(params) == 0 {
+		return sql, nil
+	}
+
+	literals := map[string]string{}
+	for _, param := range params {
+		value, ok := values[param.Name]
+		if !ok {
+			return sql, g.Error("missing value for parameter '%s'", param.Name)
+		}
+
+		literals[param.Name], err = param.Literal(connType, value)
+		if err != nil {
+			return sql, g.Error(err, "invalid value for parameter '%s'", param.Name)
+		}
+	}
+
+	matches, err := findParams(sql, backslashDialects[connType])
+	if err != nil {
+		return sql, err
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, match := range matches {
+		sb.WriteString(sql[last:match[0]])
+		sb.WriteString(literals[sql[match[2]:match[3]]])
+		last = match[1]
+	}
+	sb.WriteString(sql[last:])
+
+	return sb.String(), nil
+}
+
+// Literal returns the SQL literal of the value
+func (p Param) Literal(connType dbio.Type, value any) (literal string, err error) {
+	if !p.IsArray {
+		return p.literal(connType, value)
+	}
+
+	var values []any
+	switch v := value.(type) {
+	case string:
+		for _, val := range strings.Split(v, ",") {
+			values = append(values, strings.TrimSpace(val))
+		}
+	default:
+		values, err = cast.ToSliceE(value)
+		if err != nil {
+			return "", g.Error(err, "expected an array")
+		}
+	}
+
+	if len(values) == 0 {
+		return "NULL", nil // `in (NULL)` matches nothing
+	}
+
+	literals := make([]string, len(values))
+	for i, val := range values {
+		if literals[i], err = p.literal(connType, val); err != nil {
+			return
+		}
+	}
+	return strings.Join(literals, ", "), nil
+}
+
+func (p Param) literal(connType dbio.Type, value any) (literal string, err error) {
+	if value == nil {
+		return "NULL", nil
+	}
+
+	switch p.Type {
+	case ParamTypeInt:
+		s := strings.TrimSpace(cast.ToString(value))
+		if val, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return strconv.FormatInt(val, 10), nil
+		}
+
+		// json numbers are floats
+		val, err := strconv.ParseFloat(s, 64)
+		if err != nil || val != math.Trunc(val) || math.Abs(val) > 1<<53 {
+			return "", g.Error("expected an integer, got: %v", value)
+		}
+		return strconv.FormatFloat(val, 'f', 0, 64), nil
+
+	case ParamTypeFloat:
+		val, err := strconv.ParseFloat(strings.TrimSpace(cast.ToString(value)), 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return "", g.Error("expected a number, got: %v", value)
+		}
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+
+	case ParamTypeBool:
+		val, err := cast.ToBoolE(value)
+		if err != nil {
+			return "", g.Error("expected a boolean, got: %v", value)
+		}
+		switch connType {
+		case dbio.TypeDbSQLServer, dbio.TypeDbAzure, dbio.TypeDbAzureDWH, dbio.TypeDbOracle:
+			// no boolean literals
+			return map[bool]string{true: "1", false: "0"}[val], nil
+		}
+		return strconv.FormatBool(val), nil
+
+	case ParamTypeDate:
+		val, err := parseParamTime(value)
+		if err != nil {
+			return "", g.Error("expected a date, got: %v", value)
+		}
+		return quoteString(connType, val.Format("2006-01-02")), nil
+
+	case ParamTypeTimestamp:
+		val, err := parseParamTime(value)
+		if err != nil {
+			return "", g.Error("expected a timestamp, got: %v", value)
+		}
+		return quoteString(connType, val.Format("2006-01-02 15:04:05.999999")), nil
+	}
+
+	return quoteString(connType, cast.ToString(value)), nil
+}
+
+func parseParamTime(value any) (t time.Time, err error) {
+	if s, ok := value.(string); ok {
+		// do not accept unix timestamps in strings
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return t, g.Error("invalid time: %s", s)
+		}
+	}
+	return cast.ToTimeE(value)
+}
+
+// quoteString quotes a string literal for the dialect
+func quoteString(connType dbio.Type, val string) string {
+	switch {
+	case connType == dbio.TypeDbBigQuery:
+		// no doubled quotes, only backslash escapes
+		val = strings.ReplaceAll(val, `\`, `\\`)
+		return "'" + strings.ReplaceAll(val, "'", `\'`) + "'"
+	case backslashDialects[connType]:
+		// backslash is an escape character
+		val = strings.ReplaceAll(val, `\`, `\\`)
+	case connType == dbio.TypeDbPostgres && strings.Contains(val, `\`):
+		// an escape string reads the same whatever standard_conforming_strings is
+		val = strings.ReplaceAll(val, `\`, `\\`)
+		return "E'" + strings.ReplaceAll(val, "'", "''") + "'"
+	}
+	return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+}
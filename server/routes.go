@@ -1,7 +1,9 @@
 package server
 
 import (
+	"errors"
 	"net/http"
+	"path/filepath"
 	"strings"
 
 	"github.com/dbnet-io/dbnet/store"
@@ -44,12 +46,66 @@ var StandardRoutes = []echo.Route{
 		Path:    "/get-history",
 		Handler: GetHistory,
 	},
+	{
+		Name:    "getHistoryQuery",
+		Method:  "GET",
+		Path:    "/get-history/:id",
+		Handler: GetHistoryQuery,
+	},
+	{
+		Name:    "searchCatalog",
+		Method:  "GET",
+		Path:    "/search-catalog",
+		Handler: GetSearchCatalog,
+	},
 	{
 		Name:    "fileOperation",
 		Method:  "POST",
 		Path:    "/file-operation",
 		Handler: PostFileOperation,
 	},
+	{
+		Name:    "gitOperation",
+		Method:  "POST",
+		Path:    "/git-operation",
+		Handler: PostGitOperation,
+	},
+	{
+		Name:    "getConnectionStatus",
+		Method:  "GET",
+		Path:    "/connection-status",
+		Handler: GetConnectionStatus,
+	},
+	{
+		Name:    "getConnectionQueue",
+		Method:  "GET",
+		Path:    "/connection-queue",
+		Handler: GetConnectionQueue,
+	},
+	{
+		Name:    "addConnection",
+		Method:  "POST",
+		Path:    "/connections",
+		Handler: PostAddConnection,
+	},
+	{
+		Name:    "testConnection",
+		Method:  "POST",
+		Path:    "/connections/test",
+		Handler: PostTestConnection,
+	},
+	{
+		Name:    "editConnection",
+		Method:  "PUT",
+		Path:    "/connections/:name",
+		Handler: PutEditConnection,
+	},
+	{
+		Name:    "deleteConnection",
+		Method:  "DELETE",
+		Path:    "/connections/:name",
+		Handler: DeleteConnection,
+	},
 	{
 		Name:    "loadSession",
 		Method:  "GET",
@@ -62,6 +118,150 @@ var StandardRoutes = []echo.Route{
 		Path:    "/save-session",
 		Handler: PostSaveSession,
 	},
+	{
+		Name:    "getSavedQueries",
+		Method:  "GET",
+		Path:    "/saved-queries",
+		Handler: GetSavedQueries,
+	},
+	{
+		Name:    "getSavedQuery",
+		Method:  "GET",
+		Path:    "/saved-queries/:id",
+		Handler: GetSavedQuery,
+	},
+	{
+		Name:    "saveSavedQuery",
+		Method:  "POST",
+		Path:    "/saved-queries",
+		Handler: PostSaveSavedQuery,
+	},
+	{
+		Name:    "deleteSavedQuery",
+		Method:  "DELETE",
+		Path:    "/saved-queries/:id",
+		Handler: DeleteSavedQuery,
+	},
+	{
+		Name:    "getJobs",
+		Method:  "GET",
+		Path:    "/jobs",
+		Handler: GetJobs,
+	},
+	{
+		Name:    "saveJob",
+		Method:  "POST",
+		Path:    "/jobs",
+		Handler: PostSaveJob,
+	},
+	{
+		Name:    "getJobRuns",
+		Method:  "GET",
+		Path:    "/jobs/:id/runs",
+		Handler: GetJobRuns,
+	},
+	{
+		Name:    "runJob",
+		Method:  "POST",
+		Path:    "/jobs/:id/run",
+		Handler: PostRunJob,
+	},
+	{
+		Name:    "pauseJob",
+		Method:  "POST",
+		Path:    "/jobs/:id/pause",
+		Handler: PostPauseJob,
+	},
+	{
+		Name:    "deleteJob",
+		Method:  "DELETE",
+		Path:    "/jobs/:id",
+		Handler: DeleteJob,
+	},
+	{
+		Name:    "getDetachedQueries",
+		Method:  "GET",
+		Path:    "/detached-queries",
+		Handler: GetDetachedQueries,
+	},
+	{
+		Name:    "submitDetachedQuery",
+		Method:  "POST",
+		Path:    "/detached-queries",
+		Handler: PostSubmitDetachedQuery,
+	},
+	{
+		Name:    "getDetachedQuery",
+		Method:  "GET",
+		Path:    "/detached-queries/:id",
+		Handler: GetDetachedQueryStatus,
+	},
+	{
+		Name:    "getDetachedQueryResults",
+		Method:  "GET",
+		Path:    "/detached-queries/:id/results",
+		Handler: GetDetachedQueryResults,
+	},
+	{
+		Name:    "cancelDetachedQuery",
+		Method:  "POST",
+		Path:    "/detached-queries/:id/cancel",
+		Handler: PostCancelDetachedQuery,
+	},
+	{
+		Name:    "deleteDetachedQuery",
+		Method:  "DELETE",
+		Path:    "/detached-queries/:id",
+		Handler: DeleteDetachedQuery,
+	},
+	{
+		Name:    "getAuthStatus",
+		Method:  "GET",
+		Path:    "/auth/status",
+		Handler: GetAuthStatus,
+	},
+	{
+		Name:    "getLoginPage",
+		Method:  "GET",
+		Path:    "/auth/login",
+		Handler: GetLoginPage,
+	},
+	{
+		Name:    "login",
+		Method:  "POST",
+		Path:    "/auth/login",
+		Handler: PostLogin,
+	},
+	{
+		Name:    "logout",
+		Method:  "POST",
+		Path:    "/auth/logout",
+		Handler: PostLogout,
+	},
+	{
+		Name:    "oidcLogin",
+		Method:  "GET",
+		Path:    "/auth/oidc/login",
+		Handler: GetOIDCLogin,
+	},
+	{
+		Name:    "oidcCallback",
+		Method:  "GET",
+		Path:    "/auth/oidc/callback",
+		Handler: GetOIDCCallback,
+	},
+	{
+		Name:    "getFileEvents",
+		Method:  "GET",
+		Path:    "/file-events",
+		Handler: GetFileEvents,
+	},
+	{
+		Name:    "getAuditEvents",
+		Method:  "GET",
+		Path:    "/audit",
+		Handler: GetAuditEvents,
+	},
 }
 
 // Request is the typical request struct
@@ -76,49 +276,178 @@ type Request struct {
 }
 
 func GetSettings(c echo.Context) (err error) {
+	roots := WorkspaceRoots()
+	homeDir := HomeDir
+	if len(roots) > 0 {
+		homeDir = roots[0]
+	}
+
 	m := g.M(
-		"homeDir", HomeDir,
+		"homeDir", homeDir,
+		"workspaceRoots", roots,
 	)
 
 	return c.JSON(http.StatusOK, m)
 }
 
+// HistoryRequest is the request struct for the query history
+type HistoryRequest struct {
+	Request
+	Status      string `json:"status" query:"status"` // comma separated
+	From        string `json:"from" query:"from"`     // unix timestamp or date
+	To          string `json:"to" query:"to"`         // unix timestamp or date
+	MinDuration int64  `json:"min_duration" query:"min_duration"`
+	MaxDuration int64  `json:"max_duration" query:"max_duration"`
+	Order       string `json:"order" query:"order"` // start or rank
+	Cursor      string `json:"cursor" query:"cursor"`
+	Limit       int    `json:"limit" query:"limit"`
+	Offset      int    `json:"offset" query:"offset"`
+}
+
 // GetHistory returns a a list of queries from the history.
 func GetHistory(c echo.Context) (err error) {
-	req := Request{}
+	req := HistoryRequest{}
 	if err = c.Bind(&req); err != nil {
 		return g.ErrJSON(http.StatusBadRequest, err, "invalid get history request")
 	}
 
-	entries := []dbRestState.Query{}
-	conns := strings.Split(req.Conn, ",")
+	if req.Limit <= 0 || req.Limit > 1000 {
+		req.Limit = 100
+	}
+
+	search := store.HistorySearch{
+		Database:    req.Database,
+		MinDuration: req.MinDuration,
+		MaxDuration: req.MaxDuration,
+		OrderBy:     req.Order,
+		Cursor:      req.Cursor,
+		Limit:       req.Limit,
+		Offset:      req.Offset,
+	}
+	if req.Status != "" {
+		search.Statuses = strings.Split(req.Status, ",")
+	}
+	if search.From, err = parseTimestamp(req.From); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid from value")
+	}
+	if search.To, err = parseTimestamp(req.To); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid to value")
+	}
+	if req.Cursor != "" {
+		if _, _, err = store.ParseHistoryCursor(req.Cursor); err != nil {
+			return g.ErrJSON(http.StatusBadRequest, err, "invalid cursor value")
+		}
+	}
+
+	if req.Procedure == "get_latest" {
+		search.Conns = strings.Split(req.Conn, ",")
+	}
+	conns, restricted, err := readableConns(GetAuthUser(c), search.Conns)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get readable connections")
+	} else if restricted && len(conns) == 0 {
+		return c.JSON(200, g.M("history", []dbRestState.Query{}, "next_cursor", ""))
+	}
+	search.Conns = conns
+
+	var entries interface{} = []dbRestState.Query{}
+	var nextCursor string
 	switch req.Procedure {
 	case "get_latest":
-		err = store.Db.Order("start desc").Limit(100).
-			Where("conn in (?)", conns).Find(&entries).Error
+		entries, nextCursor, err = store.ListHistory(search)
 
 	case "search":
-		whereValues := []interface{}{}
-		orArr := []string{}
-		for _, orStr := range strings.Split(req.Name, ",") {
-			andWhere := []string{}
-			for _, word := range strings.Split(orStr, " ") {
-				andWhere = append(andWhere, g.F("(lower(conn || text || database) like ?)"))
-				whereValues = append(whereValues, g.F("%%%s%%", strings.ToLower(strings.TrimSpace(word))))
-			}
-			orArr = append(orArr, "("+strings.Join(andWhere, " and ")+")")
-		}
-		whereStr := strings.Join(orArr, " or ")
-		err = store.Db.Order("start desc").Limit(100).
-			Where(whereStr, whereValues...).Find(&entries).Error
+		search.Terms = req.Name
+		entries, nextCursor, err = store.SearchHistory(search)
 	}
 
 	if err != nil {
 		err = g.Error(err, "could not %s history", req.Procedure)
-		return
+		return g.ErrJSON(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(200, g.M("history", entries, "next_cursor", nextCursor))
+}
+
+// GetHistoryQuery returns a single query from the history.
+func GetHistoryQuery(c echo.Context) (err error) {
+	id := c.PathParam("id")
+	if id == "" {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("missing query id"))
+	}
+
+	query := dbRestState.Query{}
+	err = store.Db.Where("id = ?", id).Limit(1).Find(&query).Error
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get query %s", id)
+	} else if query.ID == "" {
+		return g.ErrJSON(http.StatusNotFound, g.Error("query %s not found", id))
+	} else if err = CheckAccess(GetAuthUser(c), query.Conn, "", AccessRead); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+
+	duration := int64(0)
+	if query.End > 0 {
+		duration = query.End - query.Start
+	}
+
+	// saved result set, if any
+	result, err := store.GetQueryResult(id)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get result of query %s", id)
+	}
+
+	return c.JSON(200, g.M("query", query, "duration", duration, "result", result))
+}
+
+// CatalogSearchRequest is the request struct for searching the catalog
+type CatalogSearchRequest struct {
+	Query      string `json:"query" query:"query"`
+	Conn       string `json:"conn" query:"conn"` // comma separated
+	Schema     string `json:"schema" query:"schema"`
+	TableType  string `json:"table_type" query:"table_type"` // table or view
+	ColumnType string `json:"column_type" query:"column_type"`
+	Kind       string `json:"kind" query:"kind"` // table or column
+	Limit      int    `json:"limit" query:"limit"`
+}
+
+// GetSearchCatalog searches the saved tables & columns of all connections
+func GetSearchCatalog(c echo.Context) (err error) {
+	req := CatalogSearchRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid search catalog request")
+	} else if strings.TrimSpace(req.Query) == "" {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("no search term provided"))
+	}
+
+	search := store.CatalogSearch{
+		Query:      req.Query,
+		Schema:     req.Schema,
+		TableType:  req.TableType,
+		ColumnType: req.ColumnType,
+		Kind:       req.Kind,
+		Limit:      req.Limit,
+	}
+	for _, conn := range strings.Split(req.Conn, ",") {
+		if conn = strings.ToLower(strings.TrimSpace(conn)); conn != "" {
+			search.Conns = append(search.Conns, conn)
+		}
+	}
+
+	conns, restricted, err := readableConns(GetAuthUser(c), search.Conns)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get readable connections")
+	} else if restricted && len(conns) == 0 {
+		return c.JSON(200, g.M("results", []store.CatalogResult{}))
 	}
+	search.Conns = conns
 
-	return c.JSON(200, g.M("history", entries))
+	results, err := store.SearchCatalog(search)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not search catalog")
+	}
+
+	return c.JSON(200, g.M("results", results))
 }
 
 // GetLoadSession loads session from store
@@ -172,6 +501,11 @@ func PostFileOperation(c echo.Context) (err error) {
 		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal file request")
 	}
 
+	if err = req.Resolve(); err != nil {
+		recordAudit(auditFileOperation(c, req, "denied", err))
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+
 	data := g.M()
 	switch req.Operation {
 	case OperationList:
@@ -184,13 +518,99 @@ func PostFileOperation(c echo.Context) (err error) {
 		data["file"] = file
 	case OperationWrite:
 		err = req.Write()
+		data["file"] = FileItem{Name: filepath.Base(req.File.Path), Path: req.File.Path, ModTs: req.File.ModTs, Hash: req.File.Hash}
 	case OperationDelete:
 		err = req.Delete()
+	case OperationRename, OperationMove:
+		var file FileItem
+		file, err = req.Move()
+		data["file"] = file
+	case OperationCopy:
+		var file FileItem
+		file, err = req.Copy()
+		data["file"] = file
+	case OperationMkdir:
+		var file FileItem
+		file, err = req.Mkdir()
+		data["file"] = file
+	default:
+		return g.ErrJSON(http.StatusBadRequest, g.Error("invalid file operation: %s", req.Operation))
 	}
-	if err != nil {
+
+	status := "success"
+	var conflict *FileConflictError
+	if errors.As(err, &conflict) {
+		status = "conflict"
+	} else if err != nil {
+		status = "error"
+	}
+	recordAudit(auditFileOperation(c, req, status, err))
+
+	if conflict != nil {
+		// current contents, for the editor to merge
+		return c.JSON(http.StatusConflict, g.M("error", conflict.Error(), "exists", conflict.Exists, "current", conflict.Current))
+	} else if err != nil {
 		err = g.Error(err, "error performing %s", req.Operation)
 		return g.ErrJSON(http.StatusInternalServerError, err)
 	}
 
 	return c.JSON(200, data)
 }
+
+// PostGitOperation operates with the git repository of a workspace folder
+func PostGitOperation(c echo.Context) (err error) {
+	req := GitRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal git request")
+	}
+
+	if err = req.Open(); err != nil {
+		recordAudit(auditGitOperation(c, req, "denied", "", err))
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+
+	data := g.M("root", req.root)
+	commit := ""
+	switch req.Operation {
+	case GitOperationStatus:
+		var files []GitFileStatus
+		files, err = req.Status()
+		data["files"] = files
+	case GitOperationDiff:
+		var diff string
+		diff, err = req.Diff()
+		data["diff"] = diff
+	case GitOperationStage:
+		err = req.Stage()
+	case GitOperationCommit:
+		commit, err = req.Commit(GetAuthUser(c))
+		data["commit"] = commit
+	case GitOperationBranches:
+		var branches []string
+		var current string
+		branches, current, err = req.Branches()
+		data["branches"] = branches
+		data["current"] = current
+	case GitOperationCheckout:
+		err = req.Checkout()
+		data["current"] = req.Branch
+	default:
+		return g.ErrJSON(http.StatusBadRequest, g.Error("invalid git operation: %s", req.Operation))
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	recordAudit(auditGitOperation(c, req, status, commit, err))
+
+	var dirty *GitDirtyError
+	if errors.As(err, &dirty) {
+		return c.JSON(http.StatusConflict, g.M("error", dirty.Error(), "files", dirty.Files))
+	} else if err != nil {
+		err = g.Error(err, "error performing git %s", req.Operation)
+		return g.ErrJSON(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(200, data)
+}
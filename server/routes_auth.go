@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/subtle"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// GetAuthStatus returns whether authentication is enabled, the
+// available login methods and the current user
+func GetAuthStatus(c echo.Context) (err error) {
+	methods := []string{}
+	if Auth.HasUsers() {
+		methods = append(methods, "password")
+	}
+	if Auth.Token != "" {
+		methods = append(methods, "token")
+	}
+	if Auth.OIDC.Issuer != "" {
+		methods = append(methods, "oidc")
+	}
+
+	return c.JSON(200, g.M(
+		"enabled", Auth.Enabled(),
+		"methods", methods,
+		"user", GetAuthUser(c),
+	))
+}
+
+// PostLogin logs in with a password or the token, and sets the session
+// cookie. Submitted from the login form, redirects to the app.
+func PostLogin(c echo.Context) (err error) {
+	req := struct {
+		Username string `json:"username" form:"username"`
+		Password string `json:"password" form:"password"`
+		Token    string `json:"token" form:"token"`
+	}{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid login request")
+	}
+
+	isForm := strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationForm)
+	loginError := func(code int, err error) error {
+		if isForm {
+			return c.Redirect(http.StatusSeeOther, "/auth/login?error="+http.StatusText(code))
+		}
+		return g.ErrJSON(code, err)
+	}
+
+	ip := c.RealIP()
+	if !failedLogins.Allowed(ip) {
+		return loginError(http.StatusTooManyRequests, g.Error("too many failed logins, try again later"))
+	}
+
+	var user *AuthUser
+	switch {
+	case req.Token != "":
+		if user = checkToken(req.Token); user == nil {
+			err = g.Error("invalid token")
+		}
+	case req.Username != "":
+		user, err = CheckPassword(req.Username, req.Password)
+	default:
+		err = g.Error("missing username or token")
+	}
+
+	if err != nil {
+		failedLogins.Fail(ip)
+		return loginError(http.StatusUnauthorized, err)
+	}
+
+	if err = NewSession(c, *user); err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not log in")
+	}
+
+	if isForm {
+		return c.Redirect(http.StatusSeeOther, RouteIndex.String())
+	}
+	return c.JSON(200, g.M("user", user))
+}
+
+// PostLogout ends the session
+func PostLogout(c echo.Context) (err error) {
+	if err = EndSession(c); err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not log out")
+	}
+	return c.JSON(200, g.M())
+}
+
+// GetLoginPage returns a minimal login form, for when the app
+// cannot be loaded without a session
+func GetLoginPage(c echo.Context) (err error) {
+	form := `<p style="color: red">%s</p>`
+	if msg := c.QueryParam("error"); msg != "" {
+		form = g.F(form, html.EscapeString(msg))
+	} else {
+		form = ""
+	}
+
+	if Auth.HasUsers() {
+		form += `
+<form method="post" action="/auth/login">
+  <input name="username" placeholder="Username" autofocus><br>
+  <input name="password" type="password" placeholder="Password"><br>
+  <button type="submit">Log In</button>
+</form>`
+	}
+	if Auth.Token != "" {
+		form += `
+<form method="post" action="/auth/login">
+  <input name="token" type="password" placeholder="Token"><br>
+  <button type="submit">Log In with Token</button>
+</form>`
+	}
+	if Auth.OIDC.Issuer != "" {
+		form += `
+<p><a href="/auth/oidc/login">Log In with SSO</a></p>`
+	}
+
+	return c.HTML(200, `<!DOCTYPE html>
+<html>
+<head><title>dbNet Login</title></head>
+<body style="font-family: sans-serif; margin: 4em auto; width: 20em">
+<h3>dbNet</h3>`+form+`
+</body>
+</html>`)
+}
+
+// GetOIDCLogin redirects to the OIDC provider to log in
+func GetOIDCLogin(c echo.Context) (err error) {
+	provider, err := GetOIDCProvider()
+	if err != nil {
+		return g.ErrJSON(http.StatusServiceUnavailable, err, "could not log in with OIDC")
+	}
+
+	url, state := provider.AuthCodeURL(oidcRedirectURL(c))
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusFound, url)
+}
+
+// GetOIDCCallback completes the OIDC login started by the same
+// browser, sets the session cookie and redirects to the app
+func GetOIDCCallback(c echo.Context) (err error) {
+	if msg := c.QueryParam("error"); msg != "" {
+		return g.ErrJSON(http.StatusUnauthorized, g.Error("OIDC login failed: %s %s", msg, c.QueryParam("error_description")))
+	}
+
+	provider, err := GetOIDCProvider()
+	if err != nil {
+		return g.ErrJSON(http.StatusServiceUnavailable, err, "could not log in with OIDC")
+	}
+
+	// the state must be the one of the login started by this browser
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return g.ErrJSON(http.StatusUnauthorized, g.Error("OIDC login state does not match the browser"))
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	user, err := provider.Exchange(oidcRedirectURL(c), state, c.QueryParam("code"))
+	if err != nil {
+		return g.ErrJSON(http.StatusUnauthorized, err, "could not log in with OIDC")
+	} else if user.Name == "" {
+		return g.ErrJSON(http.StatusUnauthorized, g.Error("no user name in OIDC id_token"))
+	} else if err = checkOIDCName(user.Name); err != nil {
+		return g.ErrJSON(http.StatusUnauthorized, err, "could not log in with OIDC")
+	}
+
+	if err = NewSession(c, *user); err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not log in")
+	}
+
+	return c.Redirect(http.StatusFound, RouteIndex.String())
+}
+
+// oidcRedirectURL is the callback URL of the request host
+func oidcRedirectURL(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host + "/auth/oidc/callback"
+}
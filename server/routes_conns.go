@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+	"github.com/slingdata-io/sling-cli/core/dbio/connection"
+)
+
+// PostAddConnection adds a connection to the dbNet env file,
+// once validated and tested (unless `skip_test`)
+func PostAddConnection(c echo.Context) (err error) {
+	req := ConnRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal connection request")
+	} else if err = checkConnAdmin(c, req.Name); err != nil {
+		return err
+	} else if err = req.checkAPI(); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid connection request")
+	}
+
+	if entry, _, err := FindConnection(req.Name); err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get connections")
+	} else if entry.Name != "" {
+		return g.ErrJSON(http.StatusConflict, g.Error("connection %s already exists (%s)", entry.Name, entry.Source))
+	}
+
+	conn, err := AddConnection(req)
+	recordAudit(auditConnection(c, AuditConnAdd, req.Name, err))
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not add connection")
+	}
+
+	return c.JSON(200, g.M("connection", connInfo(conn)))
+}
+
+// PutEditConnection changes a connection of the dbNet env file. The
+// properties of the request are merged into the existing ones.
+func PutEditConnection(c echo.Context) (err error) {
+	req := ConnRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal connection request")
+	}
+	req.Name = c.PathParam("name")
+
+	if err = checkConnAdmin(c, req.Name); err != nil {
+		return err
+	} else if err = checkConnEditable(req.Name); err != nil {
+		return err
+	} else if err = req.checkAPI(); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid connection request")
+	}
+
+	conn, err := EditConnection(req)
+	recordAudit(auditConnection(c, AuditConnEdit, req.Name, err))
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not edit connection")
+	}
+
+	return c.JSON(200, g.M("connection", connInfo(conn)))
+}
+
+// DeleteConnection removes a connection from the dbNet env file
+func DeleteConnection(c echo.Context) (err error) {
+	name := c.PathParam("name")
+	if err = checkConnAdmin(c, name); err != nil {
+		return err
+	} else if err = checkConnEditable(name); err != nil {
+		return err
+	}
+
+	err = RemoveConnection(name)
+	recordAudit(auditConnection(c, AuditConnRemove, name, err))
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not remove connection")
+	}
+
+	return c.JSON(200, g.M())
+}
+
+// PostTestConnection tests a connection without saving it. For an
+// existing connection of the dbNet env file, the properties of the
+// request are merged into the saved ones.
+func PostTestConnection(c echo.Context) (err error) {
+	req := ConnRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal connection request")
+	} else if err = checkConnAdmin(c, req.Name); err != nil {
+		return err
+	} else if err = req.checkAPI(); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid connection request")
+	}
+
+	current, err := env.GetConnection(req.Name)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get connection")
+	}
+
+	conn, err := ValidateConnection(req.Name, req.merge(expandEnv(current)))
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid connection")
+	} else if err = TestConnection(conn); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "connection test failed")
+	}
+
+	return c.JSON(200, g.M("connection", connInfo(conn)))
+}
+
+// checkConnAdmin returns a 403 error if the user is not admin on the connection
+func checkConnAdmin(c echo.Context, name string) (err error) {
+	if err = CheckAccess(GetAuthUser(c), name, "", AccessAdmin); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "not allowed to manage connection %s", name)
+	}
+	return nil
+}
+
+// checkConnEditable returns a 404 error if the connection does not exist,
+// or a 409 error if it is not defined in the dbNet env file
+func checkConnEditable(name string) (err error) {
+	entry, editable, err := FindConnection(name)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get connections")
+	} else if entry.Name == "" && !editable {
+		return g.ErrJSON(http.StatusNotFound, g.Error("connection %s does not exist", name))
+	} else if !editable {
+		return g.ErrJSON(http.StatusConflict, connNotEditableError(name))
+	}
+	return nil
+}
+
+// connInfo returns the name and type of the connection (not the credentials)
+func connInfo(conn connection.Connection) g.Map {
+	return g.M("name", strings.ToUpper(conn.Name), "type", conn.Type, "description", conn.Type.NameLong())
+}
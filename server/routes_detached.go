@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// DetachedQueryRequest is the request struct to submit a detached query
+type DetachedQueryRequest struct {
+	ID       string `json:"id"`
+	Conn     string `json:"conn"`
+	Database string `json:"database"`
+	Text     string `json:"text"`
+	Limit    int    `json:"limit"` // 0 is unlimited
+	Params   g.Map  `json:"params"`
+}
+
+// PostSubmitDetachedQuery submits a query which is not tied to the request.
+// Reattach with the returned ID.
+func PostSubmitDetachedQuery(c echo.Context) (err error) {
+	req := DetachedQueryRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal detached query")
+	} else if req.Conn == "" {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("missing connection"))
+	} else if req.Text == "" {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("missing query text"))
+	}
+
+	conn, err := dbRestState.DefaultProject().GetConnObject(req.Conn, "")
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not get connection")
+	}
+
+	sql, err := RenderParams(req.Text, conn.Type, req.Params)
+	if err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not render query parameters")
+	}
+
+	if err = CheckSQLAccess(GetAuthUser(c), req.Conn, sql); err != nil {
+		recordAudit(auditDenied(c, req.Conn, sql, err))
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+
+	event := newAuditEvent(c, AuditSQL)
+
+	dq := &DetachedQuery{DetachedQueryInfo: DetachedQueryInfo{
+		ID:       req.ID,
+		Conn:     req.Conn,
+		Database: req.Database,
+		Text:     sql,
+		Limit:    req.Limit,
+		User:     event.User,
+		ClientIP: event.ClientIP,
+	}}
+
+	var busy *ConnBusyError
+	if err = SubmitDetachedQuery(c.Request().Context(), dq); errors.As(err, &busy) {
+		return g.ErrJSON(http.StatusServiceUnavailable, err, "could not submit detached query")
+	} else if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not submit detached query")
+	}
+
+	return c.JSON(http.StatusAccepted, g.M("query", dq.Info()))
+}
+
+// GetDetachedQueries lists the running detached queries of the user
+func GetDetachedQueries(c echo.Context) (err error) {
+	queries := []DetachedQueryInfo{}
+	for _, info := range ListDetachedQueries() {
+		if checkDetachedAccess(c, info) == nil {
+			queries = append(queries, info)
+		}
+	}
+	return c.JSON(200, g.M("queries", queries))
+}
+
+// GetDetachedQueryStatus returns the status of a detached query
+func GetDetachedQueryStatus(c echo.Context) (err error) {
+	dq, err := getDetachedQuery(c, c.PathParam("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, g.M("query", dq.Info()))
+}
+
+// GetDetachedQueryResults streams the results spilled so far, as JSON lines
+// with the column names first (same as dbREST). Use `offset` and `limit`
+// to page through the rows.
+func GetDetachedQueryResults(c echo.Context) (err error) {
+	req := struct {
+		Offset int64 `query:"offset"`
+		Limit  int64 `query:"limit"`
+	}{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid detached query results request")
+	}
+
+	dq, err := getDetachedQuery(c, c.PathParam("id"))
+	if err != nil {
+		return err
+	}
+
+	info := dq.Info()
+	if len(info.Columns) == 0 {
+		return g.ErrJSON(http.StatusNotFound, g.Error("query %s has no results (status: %s)", info.ID, info.Status))
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "application/jsonlines")
+	header.Set("X-Request-ID", info.ID)
+	header.Set("X-Request-Status", string(info.Status))
+	header.Set("X-Request-Columns", g.Marshal(info.Columns))
+	header.Set("X-Request-Rows", g.F("%d", info.Rows))
+	header.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Request-Columns, X-Request-Status, X-Request-Rows")
+	c.Response().WriteHeader(http.StatusOK)
+
+	_, err = dq.ReadResults(c.Response(), req.Offset, req.Limit)
+	if err != nil {
+		g.LogError(err) // headers already sent
+	}
+	return nil
+}
+
+// PostCancelDetachedQuery cancels a running detached query
+func PostCancelDetachedQuery(c echo.Context) (err error) {
+	dq, err := getDetachedQuery(c, c.PathParam("id"))
+	if err != nil {
+		return err
+	}
+
+	if err = dq.Cancel(); err != nil {
+		return g.ErrJSON(http.StatusConflict, err, "could not cancel detached query")
+	}
+	recordAudit(auditDetachedCancel(c, dq))
+
+	return c.JSON(200, g.M("query", dq.Info()))
+}
+
+// DeleteDetachedQuery cancels the query if running, and deletes its results
+func DeleteDetachedQuery(c echo.Context) (err error) {
+	dq, err := getDetachedQuery(c, c.PathParam("id"))
+	if err != nil {
+		return err
+	}
+
+	if dq.IsRunning() {
+		if err = dq.Cancel(); err != nil {
+			return g.ErrJSON(http.StatusInternalServerError, err, "could not cancel detached query")
+		}
+		recordAudit(auditDetachedCancel(c, dq))
+	}
+
+	if !dq.Wait(30 * time.Second) {
+		return g.ErrJSON(http.StatusConflict, g.Error("query %s is still being cancelled", dq.ID))
+	}
+
+	if err = dq.Remove(); err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not delete detached query")
+	}
+
+	return c.JSON(200, g.M())
+}
+
+// getDetachedQuery returns the detached query, or a 404 error.
+// A 403 error is returned if the user cannot access it.
+func getDetachedQuery(c echo.Context, id string) (dq *DetachedQuery, err error) {
+	dq, err = GetDetachedQuery(id)
+	if err != nil {
+		return nil, g.ErrJSON(http.StatusNotFound, err)
+	} else if err = checkDetachedAccess(c, dq.Info()); err != nil {
+		return nil, g.ErrJSON(http.StatusForbidden, err)
+	}
+	return
+}
+
+// checkDetachedAccess returns an error if the user is not the owner
+// of the query, and is not allowed to run its text
+func checkDetachedAccess(c echo.Context, info DetachedQueryInfo) (err error) {
+	user := GetAuthUser(c)
+	if isOwner(user, info.User) {
+		return nil
+	}
+	if err = CheckSQLAccess(user, info.Conn, info.Text); err != nil {
+		return g.Error(err, "cannot access query %s", info.ID)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/dbnet-io/dbnet/store"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// JobScheduleEntry is a job schedule with its run state
+type JobScheduleEntry struct {
+	store.JobSchedule
+	Running bool       `json:"running"`
+	LastJob *store.Job `json:"last_job"`
+}
+
+// GetJobs lists the job schedules whose saved query the user can
+// read, with their latest run
+func GetJobs(c echo.Context) (err error) {
+	schedules := []store.JobSchedule{}
+	if err = store.Db.Order("name").Find(&schedules).Error; err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not list job schedules")
+	}
+
+	readable := map[string]bool{} // by saved query
+	entries := []JobScheduleEntry{}
+	for _, schedule := range schedules {
+		if _, ok := readable[schedule.SavedQueryID]; !ok {
+			readable[schedule.SavedQueryID] = checkJobRead(c, schedule) == nil
+		}
+		if !readable[schedule.SavedQueryID] {
+			continue
+		}
+
+		entry := JobScheduleEntry{
+			JobSchedule: schedule,
+			Running:     JobScheduler.IsRunning(schedule.ID),
+		}
+
+		jobs, err := ListScheduleJobs(schedule.ID, 1)
+		if err != nil {
+			return g.ErrJSON(http.StatusInternalServerError, err, "could not get last job")
+		} else if len(jobs) > 0 {
+			entry.LastJob = jobs[0]
+		}
+		entries = append(entries, entry)
+	}
+
+	return c.JSON(200, g.M("jobs", entries))
+}
+
+// GetJobRuns lists the latest runs of a job schedule
+func GetJobRuns(c echo.Context) (err error) {
+	req := struct {
+		Limit int `query:"limit"`
+	}{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid job runs request")
+	}
+
+	schedule, err := getJobSchedule(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if err = checkJobRead(c, schedule); err != nil {
+		return err
+	}
+
+	jobs, err := ListScheduleJobs(schedule.ID, req.Limit)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not list job runs")
+	}
+
+	return c.JSON(200, g.M("runs", jobs))
+}
+
+// PostSaveJob creates or updates a job schedule. Only its owner or an
+// admin of the connection of its saved query can update it.
+func PostSaveJob(c echo.Context) (err error) {
+	schedule := store.JobSchedule{}
+	if err = c.Bind(&schedule); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal job schedule")
+	}
+
+	if err = checkSavedQueryAccess(c, schedule.SavedQueryID); err != nil {
+		return err
+	}
+
+	// the runs have the access of the user creating the schedule
+	schedule.Owner, schedule.OwnerGroups, schedule.OwnerAuth = "", store.Tags{}, ""
+	if user := GetAuthUser(c); user != nil {
+		schedule.Owner, schedule.OwnerGroups, schedule.OwnerAuth = user.Name, user.Groups, user.Provider
+	}
+
+	if schedule.ID != "" {
+		current := store.JobSchedule{}
+		err = store.Db.Where("id = ?", schedule.ID).Limit(1).Find(&current).Error
+		if err != nil {
+			return g.ErrJSON(http.StatusInternalServerError, err, "could not get job schedule")
+		} else if current.ID != "" {
+			// replacing an existing schedule, keep its owner
+			if err = checkJobOwner(c, current); err != nil {
+				return err
+			}
+			schedule.Owner, schedule.OwnerGroups, schedule.OwnerAuth = current.Owner, current.OwnerGroups, current.OwnerAuth
+		}
+	}
+
+	if err = SaveJobSchedule(&schedule); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not save job schedule")
+	}
+
+	return c.JSON(200, g.M("job", schedule))
+}
+
+// PostRunJob runs a job schedule now. The run is
+// in the background, unless `wait` is true.
+func PostRunJob(c echo.Context) (err error) {
+	req := struct {
+		Wait bool `json:"wait" query:"wait"`
+	}{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid run job request")
+	}
+
+	schedule, err := getJobSchedule(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if JobScheduler.IsRunning(schedule.ID) {
+		return g.ErrJSON(http.StatusConflict, g.Error("job schedule %s is already running", schedule.ID))
+	} else if err = checkSavedQueryAccess(c, schedule.SavedQueryID); err != nil {
+		return err
+	}
+
+	if req.Wait {
+		job, err := JobScheduler.Run(schedule, "manual")
+		if job == nil {
+			return g.ErrJSON(http.StatusInternalServerError, err, "could not run job")
+		}
+		return c.JSON(200, g.M("job", job))
+	}
+
+	go func() {
+		if _, err := JobScheduler.Run(schedule, "manual"); err != nil {
+			g.LogError(err)
+		}
+	}()
+
+	return c.JSON(http.StatusAccepted, g.M())
+}
+
+// PostPauseJob pauses or resumes a job schedule
+func PostPauseJob(c echo.Context) (err error) {
+	req := struct {
+		Paused *bool `json:"paused" query:"paused"`
+	}{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid pause job request")
+	}
+
+	paused := req.Paused == nil || *req.Paused // pause by default
+	schedule, err := getJobSchedule(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if err = checkJobOwner(c, schedule); err != nil {
+		return err
+	}
+
+	schedule, err = PauseJobSchedule(schedule.ID, paused)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not pause job schedule")
+	}
+
+	return c.JSON(200, g.M("job", schedule))
+}
+
+// DeleteJob deletes a job schedule, by its owner or an admin of the
+// connection. The runs are kept.
+func DeleteJob(c echo.Context) (err error) {
+	schedule, err := getJobSchedule(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if err = checkJobOwner(c, schedule); err != nil {
+		return err
+	}
+
+	res := store.Db.Where("id = ?", schedule.ID).Delete(&store.JobSchedule{})
+	if res.Error != nil {
+		return g.ErrJSON(http.StatusInternalServerError, res.Error, "could not delete job schedule")
+	}
+
+	return c.JSON(200, g.M())
+}
+
+// getJobSchedule returns the schedule, or a 404 error
+func getJobSchedule(id string) (schedule store.JobSchedule, err error) {
+	err = store.Db.Where("id = ?", id).Limit(1).Find(&schedule).Error
+	if err != nil {
+		return schedule, g.ErrJSON(http.StatusInternalServerError, err, "could not get job schedule")
+	} else if schedule.ID == "" {
+		return schedule, g.ErrJSON(http.StatusNotFound, g.Error("job schedule %s not found", id))
+	}
+	return
+}
+
+// jobConn returns the connection of the saved query of the schedule,
+// empty if the saved query no longer exists
+func jobConn(schedule store.JobSchedule) (conn string, err error) {
+	savedQuery := store.SavedQuery{}
+	err = store.Db.Where("id = ?", schedule.SavedQueryID).Limit(1).Find(&savedQuery).Error
+	if err != nil {
+		return "", g.ErrJSON(http.StatusInternalServerError, err, "could not get saved query")
+	}
+	return savedQuery.Conn, nil
+}
+
+// checkJobRead returns a 403 error if the user cannot read the
+// connection of the saved query of the schedule
+func checkJobRead(c echo.Context, schedule store.JobSchedule) (err error) {
+	conn, err := jobConn(schedule)
+	if err != nil {
+		return err
+	} else if err = CheckAccess(GetAuthUser(c), conn, "", AccessRead); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "not allowed to read job schedule %s", schedule.ID)
+	}
+	return nil
+}
+
+// checkJobOwner returns a 403 error if the user is neither the owner
+// of the schedule, nor an admin of the connection of its saved query
+func checkJobOwner(c echo.Context, schedule store.JobSchedule) (err error) {
+	user := GetAuthUser(c)
+	if isOwner(user, schedule.Owner) {
+		return nil
+	}
+
+	conn, err := jobConn(schedule)
+	if err != nil {
+		return err
+	} else if err = CheckAccess(user, conn, "", AccessAdmin); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "only the owner or an admin of the connection can change job schedule %s", schedule.ID)
+	}
+	return nil
+}
+
+// checkSavedQueryAccess returns a 403 error if the user cannot run the saved query
+func checkSavedQueryAccess(c echo.Context, savedQueryID string) (err error) {
+	savedQuery := store.SavedQuery{}
+	err = store.Db.Where("id = ?", savedQueryID).Limit(1).Find(&savedQuery).Error
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not get saved query")
+	} else if savedQuery.ID == "" {
+		return nil // validated when saving
+	}
+
+	if err = CheckSQLAccess(GetAuthUser(c), savedQuery.Conn, savedQuery.Text); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+	return nil
+}
+
+// ListScheduleJobs returns the latest runs of a job schedule
+func ListScheduleJobs(scheduleID string, limit int) (jobs []*store.Job, err error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	jobs = []*store.Job{}
+	err = store.Db.Where("type = ? and json_extract(request, '$.schedule_id') = ?", JobTypeSchedule, scheduleID).
+		Order("time desc, id desc").Limit(limit).Find(&jobs).Error
+	if err != nil {
+		return nil, g.Error(err, "could not list jobs of schedule %s", scheduleID)
+	}
+	return
+}
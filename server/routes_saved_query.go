@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dbnet-io/dbnet/store"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// SavedQueryRequest is the request struct to list saved queries
+type SavedQueryRequest struct {
+	Folder string `json:"folder" query:"folder"` // includes sub-folders
+	Tag    string `json:"tag" query:"tag"`       // comma separated, must have all
+	Conn   string `json:"conn" query:"conn"`
+	Search string `json:"search" query:"search"` // name, description or text
+}
+
+// GetSavedQueries lists the saved queries of the connections the user can read
+func GetSavedQueries(c echo.Context) (err error) {
+	req := SavedQueryRequest{}
+	if err = c.Bind(&req); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid saved queries request")
+	}
+
+	tx := store.Db.Order("folder, name")
+	if folder := strings.Trim(req.Folder, "/"); folder != "" {
+		tx = tx.Where("(folder = ? or folder like ?)", folder, folder+"/%")
+	}
+	if req.Conn != "" {
+		tx = tx.Where("conn = ?", strings.ToLower(req.Conn))
+	}
+	for _, tag := range strings.Split(req.Tag, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tx = tx.Where("exists (select 1 from json_each(saved_queries.tags) where lower(value) = lower(?))", tag)
+		}
+	}
+	for _, word := range strings.Fields(req.Search) {
+		tx = tx.Where("lower(name || ' ' || description || ' ' || text) like ?", g.F("%%%s%%", strings.ToLower(word)))
+	}
+
+	savedQueries := []store.SavedQuery{}
+	if err = tx.Find(&savedQueries).Error; err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not list saved queries")
+	}
+
+	user := GetAuthUser(c)
+	readable := map[string]bool{} // by connection
+	allowed := []store.SavedQuery{}
+	for _, savedQuery := range savedQueries {
+		if _, ok := readable[savedQuery.Conn]; !ok {
+			readable[savedQuery.Conn] = CheckAccess(user, savedQuery.Conn, "", AccessRead) == nil
+		}
+		if readable[savedQuery.Conn] {
+			allowed = append(allowed, savedQuery)
+		}
+	}
+
+	return c.JSON(200, g.M("saved_queries", allowed))
+}
+
+// GetSavedQuery returns a saved query, if the user can read its connection
+func GetSavedQuery(c echo.Context) (err error) {
+	savedQuery, err := getSavedQuery(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if err = CheckAccess(GetAuthUser(c), savedQuery.Conn, "", AccessRead); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "not allowed to read saved query %s", savedQuery.ID)
+	}
+
+	params, err := ParseParams(savedQuery.Text)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not parse saved query parameters")
+	}
+
+	return c.JSON(200, g.M("saved_query", savedQuery, "params", params))
+}
+
+// PostSaveSavedQuery creates or updates a saved query. The creator is
+// its owner, only the owner or an admin of the connection can update it.
+func PostSaveSavedQuery(c echo.Context) (err error) {
+	savedQuery := store.SavedQuery{}
+	if err = c.Bind(&savedQuery); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "could not unmarshal saved query")
+	}
+
+	savedQuery.Name = strings.TrimSpace(savedQuery.Name)
+	if savedQuery.Name == "" {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("missing saved query name"))
+	}
+
+	user := GetAuthUser(c)
+	savedQuery.Owner = ""
+	if user != nil {
+		savedQuery.Owner = user.Name
+	}
+
+	if savedQuery.ID == "" {
+		savedQuery.ID = g.NewTsID("sq")
+	} else {
+		current := store.SavedQuery{}
+		err = store.Db.Where("id = ?", savedQuery.ID).Limit(1).Find(&current).Error
+		if err != nil {
+			return g.ErrJSON(http.StatusInternalServerError, err, "could not get saved query")
+		} else if current.ID != "" {
+			// replacing an existing query, keep its owner
+			if err = checkSavedQueryOwner(c, current); err != nil {
+				return err
+			}
+			savedQuery.Owner = current.Owner
+		}
+	}
+	savedQuery.Folder = strings.Trim(savedQuery.Folder, "/")
+	savedQuery.Conn = strings.ToLower(savedQuery.Conn)
+	if savedQuery.Tags == nil {
+		savedQuery.Tags = store.Tags{}
+	}
+	if _, err = ParseParams(savedQuery.Text); err != nil {
+		return g.ErrJSON(http.StatusBadRequest, err, "invalid saved query parameters")
+	} else if err = CheckSQLAccess(user, savedQuery.Conn, savedQuery.Text); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err)
+	}
+
+	err = Sync("saved_queries", &savedQuery)
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not save query")
+	}
+
+	return c.JSON(200, g.M("saved_query", savedQuery))
+}
+
+// DeleteSavedQuery deletes a saved query, by its owner or an admin of
+// the connection
+func DeleteSavedQuery(c echo.Context) (err error) {
+	savedQuery, err := getSavedQuery(c.PathParam("id"))
+	if err != nil {
+		return err
+	} else if err = checkSavedQueryOwner(c, savedQuery); err != nil {
+		return err
+	}
+
+	res := store.Db.Where("id = ?", savedQuery.ID).Delete(&store.SavedQuery{})
+	if res.Error != nil {
+		return g.ErrJSON(http.StatusInternalServerError, res.Error, "could not delete saved query")
+	}
+
+	return c.JSON(200, g.M())
+}
+
+// getSavedQuery returns the saved query, or a 404 error
+func getSavedQuery(id string) (savedQuery store.SavedQuery, err error) {
+	err = store.Db.Where("id = ?", id).Limit(1).Find(&savedQuery).Error
+	if err != nil {
+		return savedQuery, g.ErrJSON(http.StatusInternalServerError, err, "could not get saved query")
+	} else if savedQuery.ID == "" {
+		return savedQuery, g.ErrJSON(http.StatusNotFound, g.Error("saved query %s not found", id))
+	}
+	return
+}
+
+// checkSavedQueryOwner returns a 403 error if the user is neither the
+// owner of the saved query, nor an admin of its connection
+func checkSavedQueryOwner(c echo.Context, savedQuery store.SavedQuery) (err error) {
+	user := GetAuthUser(c)
+	if isOwner(user, savedQuery.Owner) {
+		return nil
+	} else if err = CheckAccess(user, savedQuery.Conn, "", AccessAdmin); err != nil {
+		return g.ErrJSON(http.StatusForbidden, err, "only the owner or an admin of the connection can change saved query %s", savedQuery.ID)
+	}
+	return nil
+}
@@ -2,12 +2,16 @@ package server
 
 import (
 	"embed"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/dbnet-io/dbnet/store"
 	dbRestServer "github.com/dbrest-io/dbrest/server"
 	"github.com/dbrest-io/dbrest/state"
 	"github.com/flarco/g"
@@ -22,6 +26,9 @@ type Server struct {
 	Port       string
 	EchoServer *echo.Echo
 	StartTime  time.Time
+	TLS        TLSConfig
+
+	redirectServer *http.Server // plain HTTP to HTTPS
 }
 
 //go:embed app
@@ -47,9 +54,26 @@ func (r RouteName) String() string {
 	return string(r)
 }
 
+var echoErrorHandler = echo.DefaultHTTPErrorHandler(false)
+
+// httpErrorHandler responds with the status and message of the
+// errors made with g.ErrJSON, otherwise uses the echo handler
+func httpErrorHandler(c echo.Context, err error) {
+	var he *g.HTTPError
+	if errors.As(err, &he) && !c.Response().Committed {
+		if cErr := c.JSON(he.Code, he.Message); cErr != nil {
+			g.LogError(cErr)
+		}
+		return
+	}
+	echoErrorHandler(c, err)
+}
+
 // NewServer creates a new server
 func NewServer() *Server {
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.IPExtractor = ipExtractor()
 	// e.Use(sentry.SentryEcho())
 	e.Use(middleware.RequestIDWithConfig(middleware.RequestIDConfig{
 		Generator: func() string {
@@ -57,16 +81,16 @@ func NewServer() *Server {
 		},
 	}))
 
-	// CORS
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		// AllowOrigins: []string{"http://localhost:5987", "http://localhost:3000", "http://localhost:3001", "tauri://localhost", "https://custom-protocol-taurilocalhost"},
-		// AllowCredentials: true,
-		// AllowHeaders: []string{"*"},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, "X-Request-ID", "X-Request-Columns", "X-Request-Continue", "access-control-allow-origin", "access-control-allow-headers"},
-		AllowOriginFunc: func(origin string) (bool, error) {
-			return true, nil
-		},
-	}))
+	// CORS, same-origin and the allowed origins only
+	CORS = LoadCORSConfig()
+	e.Use(originMiddleware)
+	e.Use(CORS.Middleware())
+
+	// authentication, for all routes
+	Auth = LoadAuthConfig()
+	e.Use(authMiddleware)
+
+	Results = store.LoadResultsBudget()
 
 	// embedded files
 	e.GET(RouteIndex.String()+"*", contentHandler, contentRewrite)
@@ -84,11 +108,21 @@ func NewServer() *Server {
 		route.Middlewares = append(route.Middlewares, middleware.Recover())
 
 		switch route.Name {
-		case "submitSQL", "submitSQL_ID", "cancelSQL", "getTableSelect":
-			route.Middlewares = append(route.Middlewares, queryMiddleware)
+		case "submitSQL", "submitSQL_ID":
+			route.Middlewares = append(route.Middlewares, queryMiddleware, paramsMiddleware, sqlAccessMiddleware, limitsMiddleware, resultsMiddleware)
+		case "getTableSelect":
+			route.Middlewares = append(route.Middlewares, tableAccessMiddleware(AccessRead), queryMiddleware, limitsMiddleware, resultsMiddleware)
+		case "tableInsert", "tableUpsert", "tableUpdate":
+			route.Middlewares = append(route.Middlewares, tableAccessMiddleware(AccessWrite), tableAuditMiddleware, schemataMiddleware)
+		case "cancelSQL":
+			route.Middlewares = append(route.Middlewares, tableAccessMiddleware(AccessRead), queryMiddleware, cancelLimitsMiddleware)
+		case "closeConnection", "getConnectionDatabases", "getConnectionSchemas", "getConnectionTables", "getConnectionColumns",
+			"getSchemaTables", "getSchemaColumns", "getTableColumns", "getTableIndexes", "getTableKeys":
+			route.Middlewares = append(route.Middlewares, tableAccessMiddleware(AccessRead), schemataMiddleware)
 		default:
 			route.Middlewares = append(route.Middlewares, schemataMiddleware)
 		}
+		route.Middlewares = append(route.Middlewares, prepareMiddleware)
 
 		e.AddRoute(route)
 	}
@@ -99,14 +133,19 @@ func NewServer() *Server {
 	}
 
 	host := os.Getenv("HOST")
-	if host == "" {
+	if host == "" && Auth.Enabled() {
 		host = "0.0.0.0" // default
+	} else if host == "" {
+		host = "127.0.0.1" // only local clients without authentication
+	} else if !Auth.Enabled() && !isLoopback(host) {
+		g.Warn("authentication is not enabled, any client reaching %s can use the server", host)
 	}
 
 	return &Server{
 		Host:       host,
 		Port:       port,
 		EchoServer: e,
+		TLS:        LoadTLSConfig(),
 	}
 }
 
@@ -122,22 +161,55 @@ func (srv *Server) Start() {
 	}()
 
 	srv.StartTime = time.Now()
-	if err := srv.EchoServer.Start(srv.Host + ":" + srv.Port); err != http.ErrServerClosed {
+	go JobScheduler.Loop()
+	go srv.Loop()
+
+	var err error
+	if srv.TLS.Enabled() {
+		err = srv.startTLS(srv.Host + ":" + srv.Port)
+	} else {
+		err = srv.EchoServer.Start(srv.Host + ":" + srv.Port)
+	}
+	if err != http.ErrServerClosed {
 		g.LogFatal(g.Error(err, "could not start server"))
 	}
 }
 
-// Loop cycles tasks
+// Loop cycles tasks: the health checks of the connections,
+// until the server is closed
 func (srv *Server) Loop() {
-	ticker6Hours := time.NewTicker(6 * time.Hour)
-	defer ticker6Hours.Stop()
-	<-ticker6Hours.C
+	ConnMonitor.Loop()
 }
 
 func (srv *Server) Hostname() string {
-	return g.F("http://%s:%s", srv.Host, srv.Port)
+	return g.F("%s://%s:%s", srv.Scheme(), srv.Host, srv.Port)
+}
+
+// isLoopback returns true if the host only accepts local clients
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Scheme returns https if TLS is enabled, otherwise http
+func (srv *Server) Scheme() string {
+	if srv.TLS.Enabled() {
+		return "https"
+	}
+	return "http"
 }
 
 func (srv *Server) Close() {
+	if srv.redirectServer != nil {
+		srv.redirectServer.Close()
+	}
+	JobScheduler.Stop()
+	ConnMonitor.Stop()
+	CloseDetachedQueries()
+	FileWatch.Close()
 	state.CloseConnections()
+	CloseTunnels()
 }
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/labstack/echo/v5"
+)
+
+// TLSConfig is the HTTPS configuration of the server, from the
+// environment variables or the `variables` section of the env file
+type TLSConfig struct {
+	CertFile     string   // DBNET_TLS_CERT
+	KeyFile      string   // DBNET_TLS_KEY
+	SelfSigned   bool     // DBNET_TLS_SELF_SIGNED, generates a certificate in the dbNet home folder
+	Hosts        []string // DBNET_TLS_HOSTS, extra host names of the self-signed certificate (comma separated)
+	RedirectPort string   // DBNET_TLS_REDIRECT_PORT, redirects plain HTTP on this port to HTTPS
+}
+
+// LoadTLSConfig loads the HTTPS configuration
+func LoadTLSConfig() (tc TLSConfig) {
+	tc.CertFile = env.GetVar("DBNET_TLS_CERT")
+	tc.KeyFile = env.GetVar("DBNET_TLS_KEY")
+	tc.SelfSigned = g.In(strings.ToLower(env.GetVar("DBNET_TLS_SELF_SIGNED")), "true", "1", "yes")
+	tc.RedirectPort = env.GetVar("DBNET_TLS_REDIRECT_PORT")
+	tc.Hosts = splitList(env.GetVar("DBNET_TLS_HOSTS"))
+	return
+}
+
+// Enabled returns true if the server is served over HTTPS
+func (tc TLSConfig) Enabled() bool {
+	return tc.CertFile != "" || tc.SelfSigned
+}
+
+// Validate checks that the certificate and key are both provided
+func (tc TLSConfig) Validate() error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return g.Error("both the TLS certificate and key must be provided")
+	} else if tc.CertFile != "" && tc.SelfSigned {
+		return g.Error("cannot use a self-signed certificate with a provided TLS certificate")
+	}
+	return nil
+}
+
+// startTLS serves over HTTPS, with the provided or self-signed
+// certificate. Starts the HTTP redirect server if configured.
+func (srv *Server) startTLS(address string) (err error) {
+	if err = srv.TLS.Validate(); err != nil {
+		return err
+	}
+
+	certFile, keyFile := srv.TLS.CertFile, srv.TLS.KeyFile
+	if srv.TLS.SelfSigned {
+		hosts := selfSignedHosts(srv.Host, srv.TLS.Hosts)
+		certFile, keyFile, err = SelfSignedCert(path.Join(env.HomeDir, "tls"), hosts)
+		if err != nil {
+			return g.Error(err, "could not get self-signed certificate")
+		}
+	}
+
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return g.Error(err, "could not read TLS certificate")
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return g.Error(err, "could not read TLS key")
+	}
+
+	if srv.TLS.RedirectPort != "" {
+		srv.redirectServer = &http.Server{
+			Addr:              srv.Host + ":" + srv.TLS.RedirectPort,
+			Handler:           redirectHandler(srv.Port),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := srv.redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				g.LogError(g.Error(err, "could not start HTTP redirect server"))
+			}
+		}()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	sc := echo.StartConfig{
+		Address:         address,
+		GracefulContext: ctx,
+		TLSConfigFunc: func(tlsConfig *tls.Config) {
+			tlsConfig.MinVersion = tls.VersionTLS12
+		},
+	}
+	return sc.StartTLS(srv.EchoServer, cert, key)
+}
+
+// selfSignedValidity is the validity of generated certificates, which
+// are regenerated when expiring within selfSignedRenewal
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenewal  = 30 * 24 * time.Hour
+)
+
+// SelfSignedCert returns the paths of the self-signed certificate and
+// key in the folder. They are generated if missing, expiring soon, or
+// not valid for all the hosts.
+func SelfSignedCert(folder string, hosts []string) (certFile, keyFile string, err error) {
+	certFile = path.Join(folder, "self-signed.crt")
+	keyFile = path.Join(folder, "self-signed.key")
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && certCovers(cert, hosts) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", g.Error(err, "could not generate TLS key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", g.Error(err, "could not generate certificate serial number")
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"dbNet"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", g.Error(err, "could not create TLS certificate")
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", g.Error(err, "could not marshal TLS key")
+	}
+
+	if err = os.MkdirAll(folder, 0700); err != nil {
+		return "", "", g.Error(err, "could not create TLS folder")
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", "", g.Error(err, "could not write TLS certificate")
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", g.Error(err, "could not write TLS key")
+	}
+
+	g.Info("generated a self-signed TLS certificate at %s", certFile)
+	return certFile, keyFile, nil
+}
+
+// certCovers returns true if the certificate is valid for the hosts
+// and does not expire soon
+func certCovers(cert *x509.Certificate, hosts []string) bool {
+	if time.Now().Add(selfSignedRenewal).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// selfSignedHosts returns the host names of the self-signed certificate
+func selfSignedHosts(host string, extra []string) (hosts []string) {
+	candidates := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		candidates = append(candidates, hostname)
+	}
+	if !g.In(host, "0.0.0.0", "::") {
+		candidates = append(candidates, host)
+	}
+
+	for _, h := range append(candidates, extra...) {
+		if h != "" && !g.In(h, hosts...) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// redirectHandler redirects plain HTTP requests to the HTTPS port
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // no port
+		}
+		url := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, url, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flarco/g"
+	"github.com/slingdata-io/sling-cli/core/dbio/connection"
+	"github.com/spf13/cast"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// TunnelConfig is the SSH tunnel of a connection, from its `tunnel_*`
+// properties. The tunnel forwards a local port to the database host,
+// through the bastion host.
+type TunnelConfig struct {
+	Host       string `json:"host"`        // bastion host, as host[:port]
+	User       string `json:"user"`        // bastion user
+	KeyFile    string `json:"key_file"`    // private key file
+	Passphrase string `json:"-"`           // passphrase of the private key
+	Agent      bool   `json:"agent"`       // authenticate with the SSH agent (SSH_AUTH_SOCK)
+	LocalPort  int    `json:"local_port"`  // local port to listen on, random if 0
+	KnownHosts string `json:"known_hosts"` // known hosts file, ~/.ssh/known_hosts by default
+	Target     string `json:"target"`      // database host:port
+}
+
+// Tunnel is an open SSH tunnel
+type Tunnel struct {
+	Name   string
+	Config TunnelConfig
+
+	client   *ssh.Client // nil once its transport is dead
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mux      sync.Mutex
+	dialMux  sync.Mutex // one reconnection at a time
+}
+
+// tunnelTimeout is the time to connect and authenticate with the bastion host
+const tunnelTimeout = 15 * time.Second
+
+var (
+	tunnels        = map[string]*Tunnel{}        // by connection name
+	tunnelsOpening = map[string]*openingTunnel{} // being opened, by connection name
+	tunnelsMux     sync.Mutex
+)
+
+// openingTunnel is a tunnel being opened, done once it is
+type openingTunnel struct {
+	config TunnelConfig
+	tunnel *Tunnel
+	err    error
+	done   chan struct{}
+}
+
+// hasTunnel returns true if the connection data has tunnel settings
+func hasTunnel(data map[string]any) bool {
+	return cast.ToString(data["tunnel_host"]) != ""
+}
+
+// NewTunnelConfig returns the tunnel settings of the connection
+func NewTunnelConfig(conn connection.Connection) (tc TunnelConfig, err error) {
+	tc = TunnelConfig{
+		Host:       cast.ToString(conn.Data["tunnel_host"]),
+		User:       cast.ToString(conn.Data["tunnel_user"]),
+		KeyFile:    expandHome(cast.ToString(conn.Data["tunnel_key_file"])),
+		Passphrase: cast.ToString(conn.Data["tunnel_passphrase"]),
+		Agent:      cast.ToBool(conn.Data["tunnel_agent"]),
+		LocalPort:  cast.ToInt(conn.Data["tunnel_local_port"]),
+		KnownHosts: expandHome(cast.ToString(conn.Data["tunnel_known_hosts"])),
+	}
+
+	if tc.Host == "" {
+		return tc, g.Error("no tunnel host specified for connection %s", conn.Name)
+	} else if tc.User == "" {
+		return tc, g.Error("no tunnel user specified for connection %s", conn.Name)
+	} else if tc.KeyFile == "" && !tc.Agent {
+		return tc, g.Error("no tunnel key file or agent specified for connection %s", conn.Name)
+	}
+
+	if _, _, err := net.SplitHostPort(tc.Host); err != nil {
+		tc.Host = net.JoinHostPort(tc.Host, "22")
+	}
+
+	if tc.KnownHosts == "" {
+		home, _ := os.UserHomeDir()
+		tc.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	// the database host, from the properties or the url
+	host, port := cast.ToString(conn.Data["host"]), cast.ToInt(conn.Data["port"])
+	if u, err := url.Parse(conn.URL()); err == nil && host == "" {
+		host, port = u.Hostname(), cast.ToInt(u.Port())
+	}
+	if host == "" {
+		return tc, g.Error("no host specified for connection %s, needed for the tunnel", conn.Name)
+	} else if port == 0 {
+		port = conn.Type.DefPort()
+	}
+	tc.Target = net.JoinHostPort(host, strconv.Itoa(port))
+
+	return tc, nil
+}
+
+// tunnelConnection returns the connection through its SSH tunnel, which
+// is opened if needed. Connections without tunnel are returned as is.
+func tunnelConnection(conn connection.Connection) (tunneled connection.Connection, err error) {
+	if !hasTunnel(conn.Data) {
+		return conn, nil
+	}
+
+	tc, err := NewTunnelConfig(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	tunnel, err := OpenTunnel(conn.Name, tc)
+	if err != nil {
+		return conn, err
+	}
+
+	data := g.M()
+	for k, v := range conn.Data {
+		if !strings.HasPrefix(k, "tunnel_") {
+			data[k] = v
+		}
+	}
+
+	localHost, localPort, _ := net.SplitHostPort(tunnel.Addr())
+	data["host"], data["port"] = localHost, cast.ToInt(localPort)
+	if u, err := url.Parse(cast.ToString(data["url"])); err == nil && u.Host != "" {
+		u.Host = tunnel.Addr()
+		data["url"] = u.String()
+	}
+
+	tunneled, err = connection.NewConnectionFromMap(g.M("name", conn.Name, "data", data, "type", conn.Type))
+	if err != nil {
+		return conn, g.Error(err, "could not load connection %s through tunnel", conn.Name)
+	}
+	return tunneled, nil
+}
+
+// OpenTunnel returns the open tunnel of the connection, or opens it.
+// A tunnel with different settings is closed and reopened. The bastion
+// host is dialed without holding the other tunnels: the concurrent calls
+// for the connection wait for it instead.
+func OpenTunnel(name string, tc TunnelConfig) (tunnel *Tunnel, err error) {
+	name = strings.ToLower(name)
+
+	for {
+		tunnelsMux.Lock()
+		if tunnel, ok := tunnels[name]; ok && tunnel.Config == tc {
+			tunnelsMux.Unlock()
+			return tunnel, nil
+		} else if opening, ok := tunnelsOpening[name]; ok {
+			tunnelsMux.Unlock()
+			<-opening.done
+			if opening.config == tc {
+				return opening.tunnel, opening.err
+			}
+			continue // opened with other settings
+		}
+
+		stale := tunnels[name]
+		delete(tunnels, name)
+		opening := &openingTunnel{config: tc, done: make(chan struct{})}
+		tunnelsOpening[name] = opening
+		tunnelsMux.Unlock()
+
+		if stale != nil {
+			stale.Close()
+		}
+		opening.tunnel, opening.err = openTunnel(name, tc)
+
+		tunnelsMux.Lock()
+		delete(tunnelsOpening, name)
+		if opening.err == nil {
+			tunnels[name] = opening.tunnel
+		}
+		tunnelsMux.Unlock()
+		close(opening.done)
+
+		return opening.tunnel, opening.err
+	}
+}
+
+// openTunnel dials the bastion host, and listens on the local port
+func openTunnel(name string, tc TunnelConfig) (tunnel *Tunnel, err error) {
+	tunnel = &Tunnel{Name: name, Config: tc, conns: map[net.Conn]struct{}{}}
+	client, err := tunnel.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel.listener, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tc.LocalPort)))
+	if err != nil {
+		client.Close()
+		return nil, g.Error(err, "could not listen on local port %d", tc.LocalPort)
+	}
+	tunnel.setClient(client)
+
+	go tunnel.serve()
+	g.Debug("opened tunnel %s -> %s -> %s", tunnel.Addr(), tc.Host, tc.Target)
+
+	return tunnel, nil
+}
+
+// CloseTunnels closes all the tunnels
+func CloseTunnels() {
+	tunnelsMux.Lock()
+	defer tunnelsMux.Unlock()
+
+	for name, tunnel := range tunnels {
+		tunnel.Close()
+		delete(tunnels, name)
+	}
+}
+
+// Addr returns the local address of the tunnel
+func (t *Tunnel) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Close stops listening, and closes the forwarded connections
+// and the SSH client
+func (t *Tunnel) Close() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+// setClient sets the SSH client of the tunnel, which is dropped once
+// its transport is dead (e.g. the bastion host restarted)
+func (t *Tunnel) setClient(client *ssh.Client) {
+	t.client = client
+	go func() {
+		client.Wait()
+		t.dropClient(client)
+	}()
+}
+
+// dropClient closes the SSH client, if it is still the one of the tunnel
+func (t *Tunnel) dropClient(client *ssh.Client) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.client == client {
+		t.client = nil
+	}
+	client.Close()
+}
+
+// getClient returns the SSH client of the tunnel, reconnected if its
+// transport is dead. The lock is not held while connecting, so that a
+// dead bastion host does not block closing the tunnel.
+func (t *Tunnel) getClient() (client *ssh.Client, err error) {
+	t.dialMux.Lock()
+	defer t.dialMux.Unlock()
+
+	t.mux.Lock()
+	client, closed := t.client, t.closed
+	t.mux.Unlock()
+	if closed {
+		return nil, g.Error("tunnel %s is closed", t.Name)
+	} else if client != nil {
+		return client, nil
+	}
+
+	g.Debug("reconnecting tunnel %s", t.Name)
+	if client, err = t.dial(); err != nil {
+		return nil, err
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.closed {
+		client.Close()
+		return nil, g.Error("tunnel %s is closed", t.Name)
+	}
+	t.setClient(client)
+	return client, nil
+}
+
+// dial opens an SSH client with the bastion host. Gives up after
+// the tunnel timeout.
+func (t *Tunnel) dial() (client *ssh.Client, err error) {
+	hostKeyCallback, err := knownhosts.New(t.Config.KnownHosts)
+	if err != nil {
+		return nil, g.Error(err, "could not load known hosts %s", t.Config.KnownHosts)
+	}
+
+	auths := []ssh.AuthMethod{}
+	if t.Config.KeyFile != "" {
+		key, err := os.ReadFile(t.Config.KeyFile)
+		if err != nil {
+			return nil, g.Error(err, "could not read tunnel key file %s", t.Config.KeyFile)
+		}
+
+		var signer ssh.Signer
+		if t.Config.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(t.Config.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, g.Error(err, "could not parse tunnel key file %s", t.Config.KeyFile)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+
+	if t.Config.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, g.Error("SSH_AUTH_SOCK is not set, cannot use the SSH agent")
+		}
+		agentConn, err := net.DialTimeout("unix", sock, tunnelTimeout)
+		if err != nil {
+			return nil, g.Error(err, "could not connect to the SSH agent")
+		}
+		defer agentConn.Close() // only used to authenticate
+		auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	config := &ssh.ClientConfig{
+		User:            t.Config.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         tunnelTimeout,
+	}
+
+	conn, err := net.DialTimeout("tcp", t.Config.Host, tunnelTimeout)
+	if err != nil {
+		return nil, g.Error(err, "could not connect to tunnel host %s", t.Config.Host)
+	}
+
+	// the handshake as well, the timeout of the config is only to connect
+	conn.SetDeadline(time.Now().Add(tunnelTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.Config.Host, config)
+	if err != nil {
+		conn.Close()
+		return nil, g.Error(err, "could not connect to tunnel host %s", t.Config.Host)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// serve forwards the local connections until the listener is closed
+func (t *Tunnel) serve() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		go t.forward(local)
+	}
+}
+
+// forward copies the data between the local connection and the
+// database, through the SSH client (reconnected if it was dropped)
+func (t *Tunnel) forward(local net.Conn) {
+	remote, err := t.dialTarget()
+	if err != nil {
+		g.LogError(g.Error(err, "could not forward to %s through tunnel %s", t.Config.Target, t.Name))
+		local.Close()
+		return
+	}
+
+	t.mux.Lock()
+	if t.closed {
+		t.mux.Unlock()
+		local.Close()
+		remote.Close()
+		return
+	}
+	t.conns[local] = struct{}{}
+	t.mux.Unlock()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+
+	local.Close()
+	remote.Close()
+
+	t.mux.Lock()
+	delete(t.conns, local)
+	t.mux.Unlock()
+}
+
+// dialTarget connects to the database through the SSH client. A
+// target refusing the connection leaves the client as is, the client
+// is only reconnected once when its transport is dead.
+func (t *Tunnel) dialTarget() (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		client, err := t.getClient()
+		if err != nil {
+			return nil, err
+		}
+
+		remote, err := client.Dial("tcp", t.Config.Target)
+		if _, refused := err.(*ssh.OpenChannelError); err == nil || refused || attempt > 1 {
+			return remote, err
+		}
+		t.dropClient(client) // transport error
+	}
+}
+
+// expandHome replaces the leading ~ of the path with the home folder
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, strings.TrimPrefix(path, "~"))
+	}
+	return path
+}
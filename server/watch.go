@@ -0,0 +1,322 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flarco/g"
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v5"
+	"github.com/spf13/cast"
+)
+
+// FileEvent is a change of a file in a watched folder
+type FileEvent struct {
+	Type  string `json:"type"` // create, modify or delete
+	Path  string `json:"path"`
+	IsDir bool   `json:"isDir"`
+	Hash  string `json:"hash,omitempty"` // of the new contents, to ignore own writes
+	Time  int64  `json:"time"`
+}
+
+// FileSubscription receives the events of the watched folders
+type FileSubscription struct {
+	Events    chan FileEvent
+	recursive bool
+	folders   map[string]bool
+}
+
+// FileWatcher watches the workspace folders opened by the clients, and
+// dispatches the changes to their subscriptions. Events of a path are
+// coalesced within fileEventDelay (editors write in bursts).
+type FileWatcher struct {
+	watcher *fsnotify.Watcher
+	folders map[string]int // watched folders, with the number of subscriptions
+	subs    map[*FileSubscription]bool
+	pending map[string]FileEvent
+	mux     sync.Mutex
+}
+
+// FileWatch is the file watcher of the server
+var FileWatch = &FileWatcher{
+	folders: map[string]int{},
+	subs:    map[*FileSubscription]bool{},
+	pending: map[string]FileEvent{},
+}
+
+const (
+	fileEventDelay       = 100 * time.Millisecond
+	maxWatchedFolders    = 2000 // per subscription
+	fileEventsBufferSize = 256
+)
+
+// Subscribe watches the folders, and their sub-folders if recursive
+func (fw *FileWatcher) Subscribe(folders []string, recursive bool) (sub *FileSubscription, err error) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	if fw.watcher == nil {
+		if fw.watcher, err = fsnotify.NewWatcher(); err != nil {
+			return nil, g.Error(err, "could not create file watcher")
+		}
+		go fw.loop(fw.watcher)
+	}
+
+	sub = &FileSubscription{
+		Events:    make(chan FileEvent, fileEventsBufferSize),
+		recursive: recursive,
+		folders:   map[string]bool{},
+	}
+
+	for _, folder := range folders {
+		if err = fw.addFolders(sub, folder); err != nil {
+			fw.removeFolders(sub)
+			return nil, err
+		}
+	}
+
+	fw.subs[sub] = true
+	return sub, nil
+}
+
+// Unsubscribe stops the subscription, and the watch of
+// the folders without other subscriptions
+func (fw *FileWatcher) Unsubscribe(sub *FileSubscription) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	delete(fw.subs, sub)
+	fw.removeFolders(sub)
+}
+
+// Close stops watching
+func (fw *FileWatcher) Close() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	if fw.watcher != nil {
+		fw.watcher.Close()
+		fw.watcher = nil
+	}
+	fw.folders = map[string]int{}
+	fw.subs = map[*FileSubscription]bool{}
+}
+
+// addFolders watches the folder (and its sub-folders if recursive)
+// for the subscription. The `.git` folders are not watched.
+func (fw *FileWatcher) addFolders(sub *FileSubscription, folder string) (err error) {
+	return filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == folder {
+				return g.Error(err, "could not watch %s", path)
+			}
+			return nil // skip unreadable sub-folders
+		} else if !entry.IsDir() || sub.folders[path] {
+			return nil
+		} else if entry.Name() == ".git" && path != folder {
+			return filepath.SkipDir
+		} else if len(sub.folders) >= maxWatchedFolders {
+			return g.Error("more than %d folders to watch in %s, watch the sub-folders instead", maxWatchedFolders, folder)
+		}
+
+		if fw.folders[path] == 0 {
+			if err = fw.watcher.Add(path); err != nil {
+				return g.Error(err, "could not watch %s", path)
+			}
+		}
+		fw.folders[path]++
+		sub.folders[path] = true
+
+		if !sub.recursive && path != folder {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// removeFolders stops watching the folders of the
+// subscription which have no other subscription
+func (fw *FileWatcher) removeFolders(sub *FileSubscription) {
+	for folder := range sub.folders {
+		if fw.folders[folder]--; fw.folders[folder] <= 0 {
+			delete(fw.folders, folder)
+			if fw.watcher != nil {
+				fw.watcher.Remove(folder)
+			}
+		}
+	}
+	sub.folders = map[string]bool{}
+}
+
+// loop collects the events of the watcher, and dispatches them
+func (fw *FileWatcher) loop(watcher *fsnotify.Watcher) {
+	ticker := time.NewTicker(fileEventDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			fw.collect(event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			g.LogError(g.Error(err, "file watcher error"))
+		case <-ticker.C:
+			fw.dispatch()
+		}
+	}
+}
+
+// collect adds the event to the pending events. A creation followed by
+// modifications stays a creation. Renames are deletions of the old path
+// (the new path is created).
+func (fw *FileWatcher) collect(event fsnotify.Event) {
+	fileEvent := FileEvent{Path: event.Name, Time: time.Now().Unix()}
+	switch {
+	case event.Has(fsnotify.Create):
+		fileEvent.Type = "create"
+	case event.Has(fsnotify.Write):
+		fileEvent.Type = "modify"
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		fileEvent.Type = "delete"
+	default:
+		return // chmod
+	}
+
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	if previous, ok := fw.pending[event.Name]; ok && previous.Type == "create" && fileEvent.Type == "modify" {
+		fileEvent.Type = "create"
+	}
+	fw.pending[event.Name] = fileEvent
+}
+
+// dispatch sends the pending events to the subscriptions
+// watching the folder of the path
+func (fw *FileWatcher) dispatch() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+
+	if fw.watcher == nil {
+		return // closed
+	}
+
+	for path, event := range fw.pending {
+		delete(fw.pending, path)
+
+		if event.Type != "delete" {
+			stat, err := os.Stat(path)
+			if err != nil {
+				continue // gone since
+			}
+			event.IsDir = stat.IsDir()
+			if stat.Mode().IsRegular() && stat.Size() <= listHashMaxBytes {
+				event.Hash, _ = hashFile(path)
+			}
+		} else if fw.folders[path] > 0 {
+			event.IsDir = true
+		}
+
+		parent := filepath.Dir(path)
+		for sub := range fw.subs {
+			if !sub.folders[parent] {
+				continue
+			}
+
+			// watch the new sub-folders
+			if event.Type == "create" && event.IsDir && sub.recursive {
+				g.LogError(fw.addFolders(sub, path), "could not watch new folder")
+			}
+
+			select {
+			case sub.Events <- event:
+			default:
+				g.Debug("dropped file event of %s, subscription is full", path)
+			}
+		}
+
+		// stop watching deleted or renamed folders
+		if event.Type == "delete" && fw.folders[path] > 0 {
+			fw.watcher.Remove(path)
+			delete(fw.folders, path)
+			for sub := range fw.subs {
+				delete(sub.folders, path)
+			}
+		}
+	}
+}
+
+// GetFileEvents streams the changes of the folders as server-sent
+// events (`file` events). The folders are the `path` query parameters,
+// with their sub-folders if `recursive`.
+func GetFileEvents(c echo.Context) (err error) {
+	roots := WorkspaceRoots()
+	if len(roots) == 0 {
+		return g.ErrJSON(http.StatusForbidden, g.Error("no workspace roots are configured, set DBNET_WORKSPACE_ROOTS"))
+	}
+
+	folders := []string{}
+	for _, path := range c.QueryParams()["path"] {
+		folder, _, err := resolveWorkspacePath(path, roots)
+		if err != nil {
+			return g.ErrJSON(http.StatusForbidden, err)
+		} else if stat, err := os.Stat(folder); err != nil || !stat.IsDir() {
+			return g.ErrJSON(http.StatusBadRequest, g.Error("path %s is not a folder", path))
+		}
+		folders = append(folders, folder)
+	}
+	if len(folders) == 0 {
+		return g.ErrJSON(http.StatusBadRequest, g.Error("missing path to watch"))
+	}
+
+	sub, err := FileWatch.Subscribe(folders, cast.ToBool(c.QueryParam("recursive")))
+	if err != nil {
+		return g.ErrJSON(http.StatusInternalServerError, err, "could not watch folders")
+	}
+	defer FileWatch.Unsubscribe(sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	writeEvent := func(name string, data any) error {
+		_, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", name, g.Marshal(data))
+		res.Flush()
+		return err
+	}
+
+	if err = writeEvent("ready", g.M("paths", folders)); err != nil {
+		return nil
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event := <-sub.Events:
+			if err = writeEvent("file", event); err != nil {
+				return nil // client gone
+			}
+		case <-ping.C:
+			if _, err = fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/flarco/g"
+)
+
+// initAuditTriggers makes the audit_events table append-only
+func initAuditTriggers() (err error) {
+	sqls := []string{
+		`create trigger if not exists audit_events_no_update before update on audit_events begin
+			select raise(abort, 'audit events are append-only');
+		end`,
+		`create trigger if not exists audit_events_no_delete before delete on audit_events begin
+			select raise(abort, 'audit events are append-only');
+		end`,
+	}
+
+	for _, sql := range sqls {
+		if err = Db.Exec(sql).Error; err != nil {
+			return g.Error(err, "could not create audit trigger")
+		}
+	}
+	return
+}
+
+// AddAuditEvent appends an event to the audit trail
+func AddAuditEvent(event *AuditEvent) (err error) {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	if err = Db.Create(event).Error; err != nil {
+		return g.Error(err, "could not add audit event")
+	}
+	return
+}
+
+// AuditFilter filters the exported audit events
+type AuditFilter struct {
+	From   int64  `json:"from"` // unix timestamp
+	To     int64  `json:"to"`   // unix timestamp
+	User   string `json:"user"`
+	Conn   string `json:"conn"`
+	Action string `json:"action"`
+}
+
+// ExportAuditEvents writes the audit events as JSON lines, oldest first
+func ExportAuditEvents(w io.Writer, filter AuditFilter) (count int, err error) {
+	query := Db.Model(&AuditEvent{}).Order("id")
+	if filter.From > 0 {
+		query = query.Where("time >= ?", filter.From)
+	}
+	if filter.To > 0 {
+		query = query.Where("time <= ?", filter.To)
+	}
+	if filter.User != "" {
+		query = query.Where("lower(user) = lower(?)", filter.User)
+	}
+	if filter.Conn != "" {
+		query = query.Where("lower(conn) = lower(?)", filter.Conn)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, g.Error(err, "could not query audit events")
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	for rows.Next() {
+		event := AuditEvent{}
+		if err = Db.ScanRows(rows, &event); err != nil {
+			return count, g.Error(err, "could not read audit event")
+		}
+		if err = encoder.Encode(event); err != nil {
+			return count, g.Error(err, "could not write audit event")
+		}
+		count++
+	}
+	return count, rows.Err()
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flarco/g"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CatalogScope is the level at which catalog entries are refreshed.
+// Empty values widen the scope (e.g. no SchemaName means connection level).
+type CatalogScope struct {
+	Connection string
+	Database   string
+	SchemaName string
+	TableName  string
+}
+
+// Where applies the scope filters to the query
+func (cs CatalogScope) Where(tx *gorm.DB) *gorm.DB {
+	tx = tx.Where("connection = ? and lower(database) = lower(?)", cs.Connection, cs.Database)
+	if cs.SchemaName != "" {
+		tx = tx.Where("lower(schema_name) = lower(?)", cs.SchemaName)
+	}
+	if cs.TableName != "" {
+		tx = tx.Where("lower(table_name) = lower(?)", cs.TableName)
+	}
+	return tx
+}
+
+// ReplaceSchemaTables saves the tables of the scope, and
+// removes the ones which do not exist anymore
+func ReplaceSchemaTables(scope CatalogScope, tables []SchemaTable) (err error) {
+	mark := time.Now()
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if len(tables) > 0 {
+			// do not overwrite num_rows, could have been analyzed
+			conflictClause := clause.OnConflict{
+				Columns:   pkColumns("schema_tables"),
+				DoUpdates: clause.AssignmentColumns([]string{"is_view", "updated_dt"}),
+			}
+			err := tx.Clauses(conflictClause).CreateInBatches(&tables, 500).Error
+			if err != nil {
+				return g.Error(err, "could not upsert schema tables")
+			}
+		}
+		return RemoveOld(tx, "schema_tables", scope, mark)
+	})
+	return
+}
+
+// ReplaceTableColumns saves the columns of the scope, and
+// removes the ones which do not exist anymore. The parent tables
+// are upserted as well, without removing old tables.
+func ReplaceTableColumns(scope CatalogScope, columns []TableColumn) (err error) {
+	mark := time.Now()
+
+	tables := []SchemaTable{}
+	tableMap := map[string]bool{}
+	for _, col := range columns {
+		key := g.F("%s.%s.%s", col.Database, col.SchemaName, col.TableName)
+		if tableMap[key] {
+			continue
+		}
+		tableMap[key] = true
+		tables = append(tables, SchemaTable{
+			Connection: col.Connection,
+			Database:   col.Database,
+			SchemaName: col.SchemaName,
+			TableName:  col.TableName,
+			IsView:     col.TableIsView,
+		})
+	}
+
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if len(columns) > 0 {
+			err := tx.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&columns, 500).Error
+			if err != nil {
+				return g.Error(err, "could not upsert table columns")
+			}
+
+			// the columns do not always provide the table type,
+			// so a known view is not overwritten
+			isView := clause.Assignment{
+				Column: clause.Column{Name: "is_view"},
+				Value:  gorm.Expr("schema_tables.is_view or excluded.is_view"),
+			}
+			conflictClause := clause.OnConflict{
+				Columns:   pkColumns("schema_tables"),
+				DoUpdates: append(clause.AssignmentColumns([]string{"updated_dt"}), isView),
+			}
+			err = tx.Clauses(conflictClause).CreateInBatches(&tables, 500).Error
+			if err != nil {
+				return g.Error(err, "could not upsert schema tables")
+			}
+		}
+		return RemoveOld(tx, "table_columns", scope, mark)
+	})
+	return
+}
+
+// CatalogSearch are the options to search the catalog
+type CatalogSearch struct {
+	Query      string   // fuzzy term to match table/column names
+	Conns      []string // filter on connections
+	Schema     string   // filter on schema
+	TableType  string   // filter on `table` or `view`
+	ColumnType string   // filter on column type
+	Kind       string   // `table`, `column` or empty for both
+	Limit      int
+}
+
+// CatalogResult is a matched table or column
+type CatalogResult struct {
+	Kind       string  `json:"kind"`
+	Connection string  `json:"connection"`
+	Database   string  `json:"database"`
+	SchemaName string  `json:"schema_name"`
+	TableName  string  `json:"table_name"`
+	IsView     bool    `json:"is_view"`
+	ColumnName string  `json:"column_name,omitempty"`
+	ColumnType string  `json:"column_type,omitempty"`
+	Score      float64 `json:"score"`
+}
+
+// SearchCatalog does a ranked fuzzy search of the table and
+// column names across all connections and databases
+func SearchCatalog(cs CatalogSearch) (results []CatalogResult, err error) {
+	cs.Query = strings.ToLower(strings.TrimSpace(cs.Query))
+	if cs.Query == "" {
+		return nil, g.Error("no search term provided")
+	}
+	if cs.Limit <= 0 {
+		cs.Limit = 100
+	}
+
+	// subsequence pattern to pre-filter candidates in sqlite
+	pattern := "%"
+	for _, r := range cs.Query {
+		if r == '%' || r == '_' || r == '\\' {
+			pattern = pattern + "\\"
+		}
+		pattern = pattern + string(r) + "%"
+	}
+
+	filter := func(tx *gorm.DB, nameCol, isViewCol string) *gorm.DB {
+		tx = tx.Where(g.F(`lower(%s) like ? escape '\'`, nameCol), pattern)
+		if len(cs.Conns) > 0 {
+			tx = tx.Where("connection in (?)", cs.Conns)
+		}
+		if cs.Schema != "" {
+			tx = tx.Where("lower(schema_name) = lower(?)", cs.Schema)
+		}
+		switch strings.ToLower(cs.TableType) {
+		case "view":
+			tx = tx.Where(isViewCol+" = ?", true)
+		case "table":
+			tx = tx.Where(isViewCol+" = ?", false)
+		}
+		return tx
+	}
+
+	if cs.Kind == "" || cs.Kind == "table" {
+		tables := []SchemaTable{}
+		err = filter(Db.Model(&SchemaTable{}), "table_name", "is_view").Find(&tables).Error
+		if err != nil {
+			return nil, g.Error(err, "could not search tables")
+		}
+
+		for _, table := range tables {
+			if score := FuzzyScore(cs.Query, table.TableName); score > 0 {
+				results = append(results, CatalogResult{
+					Kind:       "table",
+					Connection: table.Connection,
+					Database:   table.Database,
+					SchemaName: table.SchemaName,
+					TableName:  table.TableName,
+					IsView:     table.IsView,
+					Score:      score,
+				})
+			}
+		}
+	}
+
+	if cs.Kind == "" || cs.Kind == "column" {
+		columns := []TableColumn{}
+		tx := filter(Db.Model(&TableColumn{}), "name", "table_is_view")
+		if cs.ColumnType != "" {
+			tx = tx.Where("lower(type) like ?", "%"+strings.ToLower(cs.ColumnType)+"%")
+		}
+		err = tx.Find(&columns).Error
+		if err != nil {
+			return nil, g.Error(err, "could not search columns")
+		}
+
+		for _, column := range columns {
+			if score := FuzzyScore(cs.Query, column.Name); score > 0 {
+				results = append(results, CatalogResult{
+					Kind:       "column",
+					Connection: column.Connection,
+					Database:   column.Database,
+					SchemaName: column.SchemaName,
+					TableName:  column.TableName,
+					IsView:     column.TableIsView,
+					ColumnName: column.Name,
+					ColumnType: column.Type,
+					Score:      score,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].TableName+results[i].ColumnName < results[j].TableName+results[j].ColumnName
+	})
+
+	if len(results) > cs.Limit {
+		results = results[:cs.Limit]
+	}
+
+	return
+}
+
+// FuzzyScore scores how well the term matches the name.
+// Exact matches rank first, then prefixes, substrings and
+// finally subsequences. Returns 0 when not matching.
+func FuzzyScore(term, name string) (score float64) {
+	term = strings.ToLower(term)
+	name = strings.ToLower(name)
+	if term == "" || name == "" {
+		return 0
+	}
+
+	// shorter names are closer to the term
+	closeness := float64(len(term)) / float64(len(name))
+
+	switch {
+	case name == term:
+		return 100
+	case strings.HasPrefix(name, term):
+		return 80 + 10*closeness
+	case strings.Contains(name, term):
+		return 60 + 10*closeness
+	}
+
+	// subsequence, penalize gaps between matched characters
+	gaps, last, ti := 0, -1, 0
+	termRunes := []rune(term)
+	for i, r := range []rune(name) {
+		if ti < len(termRunes) && r == termRunes[ti] {
+			if last >= 0 {
+				gaps += i - last - 1
+			}
+			last = i
+			ti++
+		}
+	}
+	if ti < len(termRunes) {
+		return 0
+	}
+
+	return 40 * closeness / float64(1+gaps)
+}
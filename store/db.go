@@ -1,6 +1,9 @@
 package store
 
 import (
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/dbnet-io/dbnet/env"
@@ -39,6 +42,14 @@ func InitDB() {
 		&TableColumnStats{},
 		&dbRestState.Query{},
 		&Session{},
+		&SavedQuery{},
+		&Job{},
+		&JobSchedule{},
+		&QueryResult{},
+		&User{},
+		&AuthSession{},
+		&Grant{},
+		&AuditEvent{},
 	}
 
 	for _, table := range allTables {
@@ -52,32 +63,51 @@ func InitDB() {
 		g.LogFatal(err, "error AutoMigrating table: "+tableName)
 	}
 
+	err = initAuditTriggers()
+	g.LogFatal(err, "error creating audit triggers")
+
+	if err = initHistoryFTS(); err != nil {
+		g.Debug("history full-text search not available: %s", err.Error())
+	}
+
 	// go g.LogFatal(CleanupTasks(), "error running db cleanup tasks")
 }
 
-// Sync syncs to the store
-func Sync(table string, obj interface{}, fields ...string) (err error) {
-	pks := map[string][]string{
-		"schema_tables":      {"conn", "database", "schema_name", "table_name"},
-		"table_columns":      {"conn", "database", "schema_name", "table_name", "name"},
-		"table_column_stats": {"conn", "database", "schema_name", "table_name", "column_name"},
-		"queries":            {"id"},
-		"jobs":               {"id"},
-		"sessions":           {"name"},
+// tablePKs are the primary key columns of each table
+var tablePKs = map[string][]string{
+	"schema_tables":      {"connection", "database", "schema_name", "table_name"},
+	"table_columns":      {"connection", "database", "schema_name", "table_name", "name"},
+	"table_column_stats": {"connection", "database", "schema_name", "table_name", "column_name"},
+	"queries":            {"id"},
+	"jobs":               {"id"},
+	"sessions":           {"name"},
+	"saved_queries":      {"id"},
+	"job_schedules":      {"id"},
+	"query_results":      {"query_id"},
+	"users":              {"name"},
+	"auth_sessions":      {"token_hash"},
+	"grants":             {"principal", "conn", "schema_name"},
+}
+
+func pkColumns(table string) (cols []clause.Column) {
+	pk := tablePKs[table]
+	cols = make([]clause.Column, len(pk))
+	for i, k := range pk {
+		cols[i] = clause.Column{Name: k}
 	}
+	return cols
+}
 
+// Sync syncs to the store
+func Sync(table string, obj interface{}, fields ...string) (err error) {
 	conflictClause := clause.OnConflict{UpdateAll: true}
 	if len(fields) > 0 {
 		conflictClause = clause.OnConflict{
 			DoUpdates: clause.AssignmentColumns(fields),
 		}
 
-		if pk, ok := pks[table]; ok {
-			cols := make([]clause.Column, len(pk))
-			for i, k := range pk {
-				cols[i] = clause.Column{Name: k}
-			}
-			conflictClause.Columns = cols
+		if _, ok := tablePKs[table]; ok {
+			conflictClause.Columns = pkColumns(table)
 		} else {
 			return g.Error("did not find PK table %s", table)
 		}
@@ -90,22 +120,19 @@ func Sync(table string, obj interface{}, fields ...string) (err error) {
 	return
 }
 
-// RemoveOld removes old non-existent tables/columns
-func RemoveOld(table, conn, schemaName, tableName, columnName string) (err error) {
-
-	// pks := map[string][]string{
-	// 	"schema_tables": []string{"conn", "schema_name", "table_name"},
-	// 	"table_columns": []string{"conn", "schema_name", "table_name", "name"},
-	// }
-	// pk, ok := pks[table]
-	// if !ok {
-	// 	return g.Error("Wrong table: " + table)
-	// }
-
-	err = Db.Exec("delete from %s where updated_dt < ( select max(updated_dt) from %s where (fields) = )", table).Error
+// RemoveOld removes old non-existent tables/columns within the scope.
+// Entries which were not refreshed since `mark` are considered stale.
+func RemoveOld(tx *gorm.DB, table string, scope CatalogScope, mark time.Time) (err error) {
+	if _, ok := map[string]bool{"schema_tables": true, "table_columns": true}[table]; !ok {
+		return g.Error("Wrong table: " + table)
+	}
 
-	return err
+	err = scope.Where(tx.Table(table)).Where("updated_dt < ?", mark).Delete(nil).Error
+	if err != nil {
+		return g.Error(err, "could not remove old entries from %s", table)
+	}
 
+	return
 }
 
 // CleanupTasks cleans up the db
@@ -117,15 +144,75 @@ func CleanupTasks() (err error) {
 	// 	return g.Error(err, "could not delete old queries")
 	// }
 
+	// apply history retention policy
+	if rp := LoadRetentionPolicy(); !rp.IsEmpty() {
+		result, err := PruneHistory(rp, false)
+		if err != nil {
+			return g.Error(err, "could not prune history")
+		} else if result.Total() > 0 {
+			g.Debug("pruned %d queries from history", result.Total())
+		}
+	}
+
+	// delete expired sessions
+	err = Db.Where("expires_at < ?", time.Now().Unix()).Delete(&AuthSession{}).Error
+	if err != nil {
+		return g.Error(err, "could not delete expired sessions")
+	}
+
+	// delete saved results of queries no longer in history
+	err = Db.Exec(`delete from query_results where query_id not in (select id from queries)`).Error
+	if err != nil {
+		return g.Error(err, "could not delete old query results")
+	}
+
+	// delete spilled results of queries no longer in history
+	if err = removeOrphanSpills(); err != nil {
+		return g.Error(err, "could not remove spill files")
+	}
+
 	// vacuum
 	err = Db.Exec(`vacuum`).Error
 	if err != nil {
 		return g.Error(err, "could not vacuum")
 	}
 
+	// vacuum can change the rowids referenced by the index
+	if HistoryFTS {
+		err = RebuildHistoryFTS()
+	}
+
 	return
 }
 
+// removeOrphanSpills removes the detached query spill files
+// of the queries pruned from the history
+func removeOrphanSpills() (err error) {
+	entries, err := os.ReadDir(env.SpillDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return g.Error(err, "could not list spill folder")
+	}
+
+	mark := time.Now().Add(-time.Hour) // do not race with new queries
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(mark) {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".jsonl"), ".json")
+		var count int64
+		if err = Db.Table("queries").Where("id = ?", id).Count(&count).Error; err != nil {
+			return g.Error(err, "could not check query %s", id)
+		} else if count == 0 {
+			g.LogError(os.Remove(path.Join(env.SpillDir(), entry.Name())))
+		}
+	}
+	return nil
+}
+
 // Loop loops interval functions
 func Loop() {
 	ticker60Minute := time.NewTicker(60 * time.Minute)
@@ -0,0 +1,270 @@
+package store
+
+import (
+	"encoding/base64"
+	"strings"
+
+	dbRestState "github.com/dbrest-io/dbrest/state"
+	"github.com/flarco/g"
+	"github.com/spf13/cast"
+	"gorm.io/gorm"
+)
+
+// HistoryFTS signifies that the full-text search index is available.
+// SQLite needs to be compiled with FTS5 (build with `--tags fts5`).
+var HistoryFTS = false
+
+// initHistoryFTS creates the full-text search index of the queries table.
+// The index is kept in sync with triggers, so every `Sync("queries", ...)`
+// is reflected.
+func initHistoryFTS() (err error) {
+	if DropAll {
+		Db.Exec(`drop table if exists queries_fts`)
+	}
+
+	var count int64
+	Db.Raw(`select count(1) from sqlite_master where type = 'table' and name = 'queries_fts'`).Scan(&count)
+
+	sqls := []string{
+		`create virtual table if not exists queries_fts using fts5(
+			conn, database, text,
+			content = 'queries', content_rowid = 'rowid'
+		)`,
+		`create trigger if not exists queries_fts_ai after insert on queries begin
+			insert into queries_fts(rowid, conn, database, text)
+			values (new.rowid, new.conn, new.database, new.text);
+		end`,
+		`create trigger if not exists queries_fts_ad after delete on queries begin
+			insert into queries_fts(queries_fts, rowid, conn, database, text)
+			values ('delete', old.rowid, old.conn, old.database, old.text);
+		end`,
+		`create trigger if not exists queries_fts_au after update on queries begin
+			insert into queries_fts(queries_fts, rowid, conn, database, text)
+			values ('delete', old.rowid, old.conn, old.database, old.text);
+			insert into queries_fts(rowid, conn, database, text)
+			values (new.rowid, new.conn, new.database, new.text);
+		end`,
+	}
+
+	for _, sql := range sqls {
+		if err = Db.Exec(sql).Error; err != nil {
+			return g.Error(err, "could not create history full-text index")
+		}
+	}
+
+	if count == 0 {
+		// index existing history
+		if err = RebuildHistoryFTS(); err != nil {
+			return
+		}
+	}
+
+	HistoryFTS = true
+
+	return
+}
+
+// RebuildHistoryFTS rebuilds the full-text search index.
+// Needed after a vacuum, since the queries rowids can change.
+func RebuildHistoryFTS() (err error) {
+	if err = Db.Exec(`insert into queries_fts(queries_fts) values ('rebuild')`).Error; err != nil {
+		return g.Error(err, "could not rebuild history full-text index")
+	}
+	return
+}
+
+// HistorySearch are the options to list or search the query history
+type HistorySearch struct {
+	Terms       string   // comma separated groups of space separated words
+	Conns       []string // filter on connections
+	Database    string   // filter on database
+	Statuses    []string // filter on query statuses
+	From        int64    // start unix timestamp lower bound
+	To          int64    // start unix timestamp upper bound
+	MinDuration int64    // duration lower bound, in seconds
+	MaxDuration int64    // duration upper bound, in seconds
+	OrderBy     string   // `start` (default) or `rank`
+	Cursor      string   // continue after the entry of the cursor
+	Limit       int
+	Offset      int
+}
+
+// HistoryMatch is a query matching the history search
+type HistoryMatch struct {
+	dbRestState.Query
+	Highlight string `json:"highlight"`
+}
+
+// HistoryCursor returns the pagination cursor of a query
+func HistoryCursor(query dbRestState.Query) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(g.F("%d:%s", query.Start, query.ID)))
+}
+
+// ParseHistoryCursor returns the start and ID of the cursor entry
+func ParseHistoryCursor(cursor string) (start int64, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", g.Error(err, "invalid cursor")
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", g.Error("invalid cursor")
+	}
+
+	start, err = cast.ToInt64E(parts[0])
+	if err != nil {
+		return 0, "", g.Error(err, "invalid cursor")
+	}
+	return start, parts[1], nil
+}
+
+// filter applies the filters, ordering and pagination
+func (hs *HistorySearch) filter(tx *gorm.DB) (*gorm.DB, error) {
+	if hs.Limit <= 0 {
+		hs.Limit = 100
+	}
+
+	if len(hs.Conns) > 0 {
+		conns := make([]string, len(hs.Conns))
+		for i, conn := range hs.Conns {
+			conns[i] = strings.ToLower(conn)
+		}
+		tx = tx.Where("queries.conn in (?)", conns)
+	}
+	if hs.Database != "" {
+		tx = tx.Where("queries.database = ?", strings.ToLower(hs.Database))
+	}
+	if len(hs.Statuses) > 0 {
+		tx = tx.Where("queries.status in (?)", hs.Statuses)
+	}
+	if hs.From > 0 {
+		tx = tx.Where("queries.start >= ?", hs.From)
+	}
+	if hs.To > 0 {
+		tx = tx.Where("queries.start <= ?", hs.To)
+	}
+	if hs.MinDuration > 0 {
+		tx = tx.Where("queries.end > 0 and queries.end - queries.start >= ?", hs.MinDuration)
+	}
+	if hs.MaxDuration > 0 {
+		tx = tx.Where("queries.end > 0 and queries.end - queries.start <= ?", hs.MaxDuration)
+	}
+
+	if hs.OrderBy == "rank" {
+		tx = tx.Order("queries_fts.rank")
+	} else {
+		if hs.Cursor != "" {
+			start, id, err := ParseHistoryCursor(hs.Cursor)
+			if err != nil {
+				return tx, err
+			}
+			tx = tx.Where("(queries.start < ? or (queries.start = ? and queries.id < ?))", start, start, id)
+		}
+		tx = tx.Order("queries.start desc, queries.id desc")
+	}
+
+	// fetch one more to know if there is a next page
+	return tx.Limit(hs.Limit + 1).Offset(hs.Offset), nil
+}
+
+// nextCursor trims the extra entry and returns the next page cursor
+func (hs *HistorySearch) nextCursor(matches []HistoryMatch) ([]HistoryMatch, string) {
+	if len(matches) <= hs.Limit {
+		return matches, ""
+	}
+	matches = matches[:hs.Limit]
+	if hs.OrderBy == "rank" {
+		return matches, "" // use offset
+	}
+	return matches, HistoryCursor(matches[len(matches)-1].Query)
+}
+
+// ListHistory returns the latest queries of the history
+func ListHistory(hs HistorySearch) (entries []dbRestState.Query, nextCursor string, err error) {
+	hs.OrderBy = "start"
+	tx, err := hs.filter(Db.Table("queries").Select("queries.*"))
+	if err != nil {
+		return
+	}
+
+	matches := []HistoryMatch{}
+	if err = tx.Scan(&matches).Error; err != nil {
+		err = g.Error(err, "could not list history")
+		return
+	}
+
+	matches, nextCursor = hs.nextCursor(matches)
+	entries = make([]dbRestState.Query, len(matches))
+	for i, match := range matches {
+		entries[i] = match.Query
+	}
+
+	return
+}
+
+// SearchHistory searches the query history, using the
+// full-text index if available
+func SearchHistory(hs HistorySearch) (matches []HistoryMatch, nextCursor string, err error) {
+	matches = []HistoryMatch{}
+
+	var tx *gorm.DB
+	if HistoryFTS {
+		match := ftsMatchExpr(hs.Terms)
+		if match == "" {
+			return matches, "", nil
+		}
+
+		tx = Db.Table("queries_fts").
+			Select(`queries.*, snippet(queries_fts, 2, '<mark>', '</mark>', '...', 24) as highlight`).
+			Joins("join queries on queries.rowid = queries_fts.rowid").
+			Where("queries_fts match ?", match)
+	} else {
+		hs.OrderBy = "start" // no rank without index
+
+		whereValues := []interface{}{}
+		orArr := []string{}
+		for _, orStr := range strings.Split(hs.Terms, ",") {
+			andWhere := []string{}
+			for _, word := range strings.Split(orStr, " ") {
+				andWhere = append(andWhere, g.F("(lower(conn || text || database) like ?)"))
+				whereValues = append(whereValues, g.F("%%%s%%", strings.ToLower(strings.TrimSpace(word))))
+			}
+			orArr = append(orArr, "("+strings.Join(andWhere, " and ")+")")
+		}
+		whereStr := strings.Join(orArr, " or ")
+		tx = Db.Table("queries").Where(whereStr, whereValues...)
+	}
+
+	tx, err = hs.filter(tx)
+	if err != nil {
+		return
+	}
+
+	if err = tx.Scan(&matches).Error; err != nil {
+		err = g.Error(err, "could not search history")
+		return
+	}
+
+	matches, nextCursor = hs.nextCursor(matches)
+
+	return
+}
+
+// ftsMatchExpr converts the search terms into a FTS5 match expression.
+// Comma separated groups are OR'ed, words within a group are AND'ed
+// and matched as prefixes.
+func ftsMatchExpr(terms string) string {
+	orArr := []string{}
+	for _, orStr := range strings.Split(terms, ",") {
+		andArr := []string{}
+		for _, word := range strings.Fields(orStr) {
+			word = strings.ReplaceAll(word, `"`, `""`)
+			andArr = append(andArr, g.F(`"%s"*`, word))
+		}
+		if len(andArr) > 0 {
+			orArr = append(orArr, "("+strings.Join(andArr, " AND ")+")")
+		}
+	}
+	return strings.Join(orArr, " OR ")
+}
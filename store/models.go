@@ -122,3 +122,108 @@ type Session struct {
 	CreatedDt time.Time `json:"created_dt" gorm:"autoCreateTime"`
 	UpdatedDt time.Time `json:"updated_dt" gorm:"autoUpdateTime"`
 }
+
+type Tags []string
+
+// Scan scan value into Jsonb, implements sql.Scanner interface
+func (t *Tags) Scan(value interface{}) error {
+	return g.JSONScanner(t, value)
+}
+
+// Value return json value, implement driver.Valuer interface
+func (t Tags) Value() (driver.Value, error) {
+	return g.JSONValuer(t, "[]")
+}
+
+// SavedQuery represents a saved query / snippet
+type SavedQuery struct {
+	ID          string    `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"index:idx_saved_query_name"`
+	Folder      string    `json:"folder" gorm:"index:idx_saved_query_folder"` // slash separated path
+	Tags        Tags      `json:"tags" gorm:"type:json not null default '[]'"`
+	Conn        string    `json:"conn" gorm:"index:idx_saved_query_conn"`
+	Database    string    `json:"database"`
+	Text        string    `json:"text"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"` // user who created it, empty if saved without authentication
+	CreatedDt   time.Time `json:"created_dt" gorm:"autoCreateTime"`
+	UpdatedDt   time.Time `json:"updated_dt" gorm:"autoUpdateTime"`
+}
+
+// JobSchedule represents a saved query run on a cron schedule.
+// Each run is recorded as a Job.
+type JobSchedule struct {
+	ID           string    `json:"id" gorm:"primaryKey"`
+	Name         string    `json:"name"`
+	SavedQueryID string    `json:"saved_query_id" gorm:"index:idx_job_schedule_saved_query"`
+	Cron         string    `json:"cron"`
+	Params       g.Map     `json:"params" gorm:"type:json not null default '{}'"`
+	Paused       bool      `json:"paused"`
+	LastRun      int64     `json:"last_run"`
+	NextRun      int64     `json:"next_run" gorm:"index:idx_job_schedule_next_run"`
+	RunningAt    int64     `json:"running_at"` // heartbeat of the running job, 0 if none
+	Owner        string    `json:"owner"`      // user whose grants apply to the runs, none if empty
+	OwnerGroups  Tags      `json:"owner_groups" gorm:"type:json not null default '[]'"`
+	OwnerAuth    string    `json:"owner_auth"` // provider of the owner: password, token or oidc
+	CreatedDt    time.Time `json:"created_dt" gorm:"autoCreateTime"`
+	UpdatedDt    time.Time `json:"updated_dt" gorm:"autoUpdateTime"`
+}
+
+// QueryResult is the saved result set of a query, within the results budget
+type QueryResult struct {
+	QueryID   string    `json:"query_id" gorm:"primaryKey"`
+	Headers   Headers   `json:"headers" gorm:"type:json not null default '[]'"`
+	Rows      Rows      `json:"rows" gorm:"type:json not null default '[]'"`
+	NumRows   int       `json:"num_rows"`
+	Bytes     int64     `json:"bytes"`
+	Truncated bool      `json:"truncated"` // more rows than the budget
+	CreatedDt time.Time `json:"created_dt" gorm:"autoCreateTime"`
+}
+
+// User is a local user, authenticating with a password
+type User struct {
+	Name         string    `json:"name" gorm:"primaryKey"`
+	PasswordHash string    `json:"-"` // bcrypt
+	Groups       Tags      `json:"groups" gorm:"type:json not null default '[]'"`
+	CreatedDt    time.Time `json:"created_dt" gorm:"autoCreateTime"`
+	UpdatedDt    time.Time `json:"updated_dt" gorm:"autoUpdateTime"`
+}
+
+// AuthSession is a logged-in session, referenced by the session cookie
+type AuthSession struct {
+	TokenHash string    `json:"-" gorm:"primaryKey"` // sha256 of the cookie value
+	User      string    `json:"user" gorm:"index:idx_auth_session_user"`
+	Groups    Tags      `json:"groups" gorm:"type:json not null default '[]'"`
+	Provider  string    `json:"provider"` // password, token or oidc
+	ExpiresAt int64     `json:"expires_at" gorm:"index:idx_auth_session_expires"`
+	CreatedDt time.Time `json:"created_dt" gorm:"autoCreateTime"`
+}
+
+// Grant gives a user or group an access level on a connection,
+// or on a schema of the connection
+type Grant struct {
+	Principal string    `json:"principal" gorm:"primaryKey"`                 // user:<name> or group:<name>
+	Conn      string    `json:"conn" gorm:"primaryKey"`                      // connection name, or * for all
+	Schema    string    `json:"schema" gorm:"column:schema_name;primaryKey"` // empty for all schemas
+	Level     string    `json:"level"`                                       // read, write or admin
+	CreatedDt time.Time `json:"created_dt" gorm:"autoCreateTime"`
+	UpdatedDt time.Time `json:"updated_dt" gorm:"autoUpdateTime"`
+}
+
+// AuditEvent is an entry of the audit trail: an executed query or a
+// file write or delete. The table is append-only.
+type AuditEvent struct {
+	ID           int64   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Time         int64   `json:"time" gorm:"index:idx_audit_event_time"`
+	User         string  `json:"user" gorm:"index:idx_audit_event_user"` // empty if authentication is disabled
+	ClientIP     string  `json:"client_ip"`
+	Action       string  `json:"action"` // sql, sql_cancel, sql_denied, file_write, file_delete or file_move
+	Conn         string  `json:"conn" gorm:"index:idx_audit_event_conn"`
+	Database     string  `json:"database"`
+	QueryID      string  `json:"query_id"`
+	Text         string  `json:"text"` // the sql, or the file path
+	Status       string  `json:"status"`
+	Err          string  `json:"err"`
+	RowsAffected int64   `json:"rows_affected"` // -1 if unknown
+	Duration     float64 `json:"duration"`      // seconds
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/spf13/cast"
+)
+
+// ResultsBudget caps the size of each saved result set.
+// A MaxRows of 0 disables saving results.
+type ResultsBudget struct {
+	MaxRows  int   `json:"max_rows"`  // DBNET_RESULTS_MAX_ROWS (default: 0, off)
+	MaxBytes int64 `json:"max_bytes"` // DBNET_RESULTS_MAX_SIZE_MB (default: 5)
+}
+
+// LoadResultsBudget loads the results budget from the environment
+// variables, or the `variables` section of the dbNet env file
+func LoadResultsBudget() (rb ResultsBudget) {
+	rb = ResultsBudget{MaxRows: 0, MaxBytes: 5 * 1024 * 1024}
+	if val := env.GetVar("DBNET_RESULTS_MAX_ROWS"); val != "" {
+		rb.MaxRows = cast.ToInt(val)
+	}
+	if val := env.GetVar("DBNET_RESULTS_MAX_SIZE_MB"); val != "" {
+		rb.MaxBytes = int64(cast.ToFloat64(val) * 1024 * 1024)
+	}
+	return
+}
+
+// IsEnabled returns true if results should be saved
+func (rb ResultsBudget) IsEnabled() bool {
+	return rb.MaxRows > 0 && rb.MaxBytes > 0
+}
+
+// ParseResult parses the rows of a dbREST response body, up to the budget.
+// The content type is `application/jsonlines` (first line is the column
+// names), `application/json` (array of records), `text/csv` or `text/plain` (TSV).
+// Set truncated when the body was cut.
+func (rb ResultsBudget) ParseResult(contentType string, headers []string, body []byte, truncated bool) (result QueryResult, err error) {
+	result = QueryResult{Headers: headers, Rows: Rows{}, Truncated: truncated}
+
+	addRow := func(row []any, size int) bool {
+		if len(result.Rows) >= rb.MaxRows || result.Bytes+int64(size) > rb.MaxBytes {
+			result.Truncated = true
+			return false
+		}
+		result.Rows = append(result.Rows, row)
+		result.Bytes += int64(size)
+		return true
+	}
+
+	if truncated {
+		// drop the incomplete last line
+		if i := bytes.LastIndexByte(body, '\n'); i >= 0 {
+			body = body[:i+1]
+		} else {
+			body = nil
+		}
+	}
+
+	switch strings.Split(strings.ToLower(contentType), ";")[0] {
+	case "application/jsonlines":
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), int(rb.MaxBytes)+1)
+		for i := 0; scanner.Scan(); i++ {
+			if i == 0 {
+				continue // column names
+			}
+			row := []any{}
+			if err = decodeJSON(scanner.Bytes(), &row); err != nil {
+				return result, g.Error(err, "could not parse result row")
+			}
+			if !addRow(row, len(scanner.Bytes())) {
+				break
+			}
+		}
+
+	case "application/json":
+		if truncated {
+			return result, g.Error("cannot parse a truncated json result")
+		}
+		records := []map[string]any{}
+		if err = decodeJSON(body, &records); err != nil {
+			return result, g.Error(err, "could not parse result records")
+		}
+		for _, rec := range records {
+			row := make([]any, len(headers))
+			for i, header := range headers {
+				row[i] = rec[header]
+			}
+			if !addRow(row, len(g.Marshal(row))) {
+				break
+			}
+		}
+
+	case "text/csv", "text/plain":
+		reader := csv.NewReader(bytes.NewReader(body))
+		if strings.HasPrefix(contentType, "text/plain") {
+			reader.Comma = '\t'
+		}
+		reader.FieldsPerRecord = -1
+		for i := 0; ; i++ {
+			rec, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return result, g.Error(err, "could not parse csv result")
+			} else if i == 0 {
+				continue // column names
+			}
+			row := make([]any, len(rec))
+			size := 0
+			for j, val := range rec {
+				row[j] = val
+				size += len(val) + 1
+			}
+			if !addRow(row, size) {
+				break
+			}
+		}
+
+	default:
+		return result, g.Error("unsupported result content type: %s", contentType)
+	}
+
+	result.NumRows = len(result.Rows)
+	return result, nil
+}
+
+// decodeJSON decodes without losing the precision of large numbers
+func decodeJSON(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// SaveQueryResult saves the result set of a query
+func SaveQueryResult(result *QueryResult) (err error) {
+	if result.QueryID == "" {
+		return g.Error("missing query id for result")
+	}
+	if err = Sync("query_results", result); err != nil {
+		return g.Error(err, "could not save result of query %s", result.QueryID)
+	}
+	return
+}
+
+// GetQueryResult returns the saved result set of a query.
+// Returns nil if there is none.
+func GetQueryResult(queryID string) (result *QueryResult, err error) {
+	results := []QueryResult{}
+	err = Db.Where("query_id = ?", queryID).Limit(1).Find(&results).Error
+	if err != nil {
+		return nil, g.Error(err, "could not get result of query %s", queryID)
+	} else if len(results) == 0 {
+		return nil, nil
+	}
+	return &results[0], nil
+}
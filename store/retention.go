@@ -0,0 +1,117 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dbnet-io/dbnet/env"
+	"github.com/flarco/g"
+	"github.com/spf13/cast"
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy caps the size of the query history.
+// Zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAgeDays    int   `json:"max_age_days"`    // DBNET_HISTORY_MAX_AGE_DAYS
+	MaxPerConn    int   `json:"max_per_conn"`    // DBNET_HISTORY_MAX_PER_CONN
+	MaxTotalBytes int64 `json:"max_total_bytes"` // DBNET_HISTORY_MAX_SIZE_MB
+}
+
+// IsEmpty returns true if no limit is set
+func (rp RetentionPolicy) IsEmpty() bool {
+	return rp.MaxAgeDays <= 0 && rp.MaxPerConn <= 0 && rp.MaxTotalBytes <= 0
+}
+
+// LoadRetentionPolicy loads the retention policy from the environment
+// variables, or the `variables` section of the dbNet env file
+func LoadRetentionPolicy() (rp RetentionPolicy) {
+	rp.MaxAgeDays = cast.ToInt(env.GetVar("DBNET_HISTORY_MAX_AGE_DAYS"))
+	rp.MaxPerConn = cast.ToInt(env.GetVar("DBNET_HISTORY_MAX_PER_CONN"))
+	rp.MaxTotalBytes = int64(cast.ToFloat64(env.GetVar("DBNET_HISTORY_MAX_SIZE_MB")) * 1024 * 1024)
+	return
+}
+
+// PruneResult is the count of queries pruned per limit
+type PruneResult struct {
+	ByAge   int  `json:"by_age"`
+	ByCount int  `json:"by_count"`
+	BySize  int  `json:"by_size"`
+	DryRun  bool `json:"dry_run"`
+}
+
+// Total returns the total count of pruned queries
+func (pr PruneResult) Total() int {
+	return pr.ByAge + pr.ByCount + pr.BySize
+}
+
+// errDryRun rolls back the deletes of a dry run
+var errDryRun = errors.New("dry run")
+
+// PruneHistory deletes the queries exceeding the retention policy.
+// The limits are applied in order: age, count per connection and total size.
+// When dryRun is true, the deletes are rolled back, so that each limit
+// is counted over the queries left by the previous ones, as in a real run.
+func PruneHistory(rp RetentionPolicy, dryRun bool) (result PruneResult, err error) {
+	result.DryRun = dryRun
+
+	err = Db.Transaction(func(tx *gorm.DB) (err error) {
+		prune := func(sql string, args ...any) (count int, err error) {
+			ids := []string{}
+			err = tx.Raw(sql, args...).Scan(&ids).Error
+			if err != nil {
+				return 0, g.Error(err, "could not select queries to prune")
+			}
+
+			for i := 0; i < len(ids); i += 500 {
+				batch := ids[i:min(i+500, len(ids))]
+				err = tx.Exec(`delete from queries where id in (?)`, batch).Error
+				if err != nil {
+					return 0, g.Error(err, "could not delete pruned queries")
+				}
+			}
+			return len(ids), nil
+		}
+
+		if rp.MaxAgeDays > 0 {
+			mark := time.Now().Add(-time.Duration(rp.MaxAgeDays) * 24 * time.Hour).Unix()
+			result.ByAge, err = prune(`select id from queries where start < ?`, mark)
+			if err != nil {
+				return g.Error(err, "could not prune history by age")
+			}
+		}
+
+		if rp.MaxPerConn > 0 {
+			result.ByCount, err = prune(`
+				select id from (
+					select id, row_number() over (partition by conn order by start desc, id desc) as rn
+					from queries
+				) where rn > ?`, rp.MaxPerConn)
+			if err != nil {
+				return g.Error(err, "could not prune history by count")
+			}
+		}
+
+		if rp.MaxTotalBytes > 0 {
+			result.BySize, err = prune(`
+				select id from (
+					select id, sum(length(text) + ifnull(length(err), 0) + ifnull(length(headers), 0))
+						over (order by start desc, id desc) as total_bytes
+					from queries
+				) where total_bytes > ?`, rp.MaxTotalBytes)
+			if err != nil {
+				return g.Error(err, "could not prune history by size")
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+
+	return
+}